@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 type adminAPI struct {
@@ -15,12 +16,13 @@ type adminAPI struct {
 	password string
 }
 
-func (a adminAPI) FindGroupForBucketHandler(w http.ResponseWriter, r *http.Request) {
+// Checks the basic auth credentials against the broker credentials. Writes the error response and returns false if they don't match.
+func (a adminAPI) authorized(w http.ResponseWriter, r *http.Request) bool {
 	username, password, ok := r.BasicAuth()
 	if !ok {
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "Please provide the broker username and password")
-		return
+		return false
 	}
 
 	usernameHash := sha256.Sum256([]byte(username))
@@ -33,6 +35,14 @@ func (a adminAPI) FindGroupForBucketHandler(w http.ResponseWriter, r *http.Reque
 
 	if !usernameMatch || !passwordMatch {
 		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (a adminAPI) FindGroupForBucketHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
 		return
 	}
 
@@ -71,6 +81,11 @@ func (a adminAPI) FindGroupForBucket(bucketName, lastGroupURN string) (string, e
 
 	var lastGrpUrn string
 	for _, grp := range grps {
+		lastGrpUrn = grp.GroupURN
+		if isBindingGroup(grp) {
+			continue
+		}
+
 		bckts, err := a.b.getBucketsFromGroup(grp)
 		if err != nil {
 			continue
@@ -78,11 +93,10 @@ func (a adminAPI) FindGroupForBucket(bucketName, lastGroupURN string) (string, e
 
 		for _, bckt := range bckts {
 			if bckt.name == bucketName {
-				return grp.DisplayName, nil
+				//the display name is descriptive, the unique name is the one the group is looked up by
+				return strings.TrimPrefix(grp.UniqueName, "group/"), nil
 			}
 		}
-
-		lastGrpUrn = grp.GroupURN
 	}
 
 	return a.FindGroupForBucket(bucketName, lastGrpUrn) //if still not found repeat request for the next page using the last groupURN as a marker. recursive! yeah!
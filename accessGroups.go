@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+const (
+	accessReadWrite         = "read-write"
+	accessReadOnly          = "read-only"
+	accessWriteOnly         = "write-only"
+	accessReadWriteNoDelete = "read-write-no-delete"
+)
+
+// Bindings with an access level other than read-write are placed in a separate group per instance with a narrower policy.
+// The group name is the instance group name followed by one of these suffixes. The suffixes contain non-hex characters so they never clash with an instance group.
+var accessGroupSuffixes = map[string]string{
+	accessReadOnly:          "ro",
+	accessWriteOnly:         "wo",
+	accessReadWriteNoDelete: "rwnd",
+}
+
+// Bindings restricted to a subset of the buckets or to prefixes get a group of their own named after the binding followed by this suffix
+const bindingGroupSuffix = "bind"
+
+// Access level and binding groups are marked by the start of their display name: "[<access level>] <instance group>" or "[binding] <user name>".
+// Display names of instance groups never start with "[", see platformContext.displayName.
+const bindingGroupMarker = "[binding] "
+
+type BindParameters struct {
+	Access   string              `json:"access"`
+	Buckets  []string            `json:"buckets"`
+	Prefixes map[string][]string `json:"prefixes"`
+}
+
+func getBindParams(rawParams json.RawMessage) (BindParameters, error) {
+	params := BindParameters{
+		Access: accessReadWrite,
+	}
+
+	if len(rawParams) == 0 {
+		return params, nil
+	}
+
+	err := json.Unmarshal(rawParams, &params)
+	if err != nil {
+		return BindParameters{}, apiresponses.ErrRawParamsInvalid
+	}
+
+	if params.Access == "" {
+		params.Access = accessReadWrite
+	}
+
+	if _, ok := policyTemplates[params.Access]; !ok {
+		return BindParameters{}, apiresponses.NewFailureResponse(fmt.Errorf("Unknown access level %s. Use read-only, write-only, read-write-no-delete or read-write", params.Access), http.StatusBadRequest, "invalid-access-level")
+	}
+
+	for friendlyName, prefixes := range params.Prefixes {
+		if len(prefixes) == 0 {
+			return BindParameters{}, apiresponses.NewFailureResponse(fmt.Errorf("No prefixes given for bucket %s", friendlyName), http.StatusBadRequest, "invalid-prefix")
+		}
+
+		for _, prefix := range prefixes {
+			if prefix == "" || strings.ContainsAny(prefix, "*?") {
+				return BindParameters{}, apiresponses.NewFailureResponse(fmt.Errorf("Invalid prefix \"%s\" for bucket %s. Prefixes can't be empty or contain wildcards", prefix, friendlyName), http.StatusBadRequest, "invalid-prefix")
+			}
+		}
+	}
+
+	return params, nil
+}
+
+// Returns true when the binding is restricted to some of the buckets or to prefixes and therefore needs a group of its own
+func (p BindParameters) scoped() bool {
+	return len(p.Buckets) > 0 || len(p.Prefixes) > 0
+}
+
+func accessGroupName(instance, access string) string {
+	return instance + accessGroupSuffixes[access]
+}
+
+func bindingGroupName(userName string) string {
+	return userName + bindingGroupSuffix
+}
+
+func accessGroupDisplayName(instance, access string) string {
+	return fmt.Sprintf("[%s] %s", access, instance)
+}
+
+func bindingGroupDisplayName(userName string) string {
+	return bindingGroupMarker + userName
+}
+
+// Returns true if the group belongs to an access level or a single binding instead of being the group of an instance
+func isBindingGroup(grp sgGroup) bool {
+	if strings.HasPrefix(grp.DisplayName, bindingGroupMarker) {
+		return true
+	}
+
+	for access := range accessGroupSuffixes {
+		if strings.HasPrefix(grp.DisplayName, fmt.Sprintf("[%s] ", access)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the group for bindings with the given access level. The group is created when it doesn't exist yet, otherwise its policy is brought up to date.
+func (b *broker) getAccessGroup(instanceGroup sgGroup, instance, access string, buckets map[string]Bucket) (sgGroup, error) {
+	if access == accessReadWrite {
+		return instanceGroup, nil
+	}
+
+	groupName := accessGroupName(instance, access)
+	displayName := accessGroupDisplayName(instance, access)
+	policy, err := GenerateS3AccessPolicy(instance, access, buckets)
+	if err != nil {
+		return sgGroup{}, fmt.Errorf("Generating policy failed: %s", err)
+	}
+
+	grp, err := b.sgClient.GetGroupByName(groupName)
+	if err == nil {
+		if !equalPolicies(grp.Policies, policy) || grp.DisplayName != displayName {
+			grp.DisplayName = displayName
+			return b.sgClient.UpdateGroupPolicy(grp, policy)
+		}
+		return grp, nil
+	}
+
+	if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+		return sgGroup{}, fmt.Errorf("Error retrieving group %s: %s", groupName, err)
+	}
+
+	log.Printf("Creating %s group with name: %s", access, groupName)
+	grp, err = b.sgClient.CreateGroup(groupName, displayName, policy)
+	if err != nil {
+		//another bind might have created it in the meantime
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusConflict {
+			return b.sgClient.GetGroupByName(groupName)
+		}
+		return sgGroup{}, fmt.Errorf("Group Creation Failed: %s", err)
+	}
+
+	return grp, nil
+}
+
+// Returns the buckets a binding is restricted to, including the prefixes it is restricted to within those buckets. Returns all buckets if the binding isn't restricted.
+func selectBindBuckets(params BindParameters, buckets map[string]Bucket) (map[string]Bucket, error) {
+	//a copy, the prefixes of this binding must not end up in the buckets of the instance
+	selected := make(map[string]Bucket)
+	if len(params.Buckets) == 0 {
+		for friendlyName, bckt := range buckets {
+			selected[friendlyName] = bckt
+		}
+	} else {
+		for _, friendlyName := range params.Buckets {
+			bckt, ok := buckets[friendlyName]
+			if !ok {
+				return nil, apiresponses.NewFailureResponse(fmt.Errorf("Bucket %s does not exist in this service instance", friendlyName), http.StatusBadRequest, "unknown-bucket")
+			}
+			selected[friendlyName] = bckt
+		}
+	}
+
+	for friendlyName, prefixes := range params.Prefixes {
+		bckt, ok := selected[friendlyName]
+		if !ok {
+			return nil, apiresponses.NewFailureResponse(fmt.Errorf("Prefixes given for bucket %s which is not part of this binding", friendlyName), http.StatusBadRequest, "unknown-bucket")
+		}
+		bckt.prefixes = prefixes
+		selected[friendlyName] = bckt
+	}
+
+	return selected, nil
+}
+
+// Returns the group for a binding restricted to a subset of the buckets or to prefixes. The group is created when it doesn't exist yet, otherwise its policy is brought up to date.
+// Bucket names are never reused so the policy of a binding group doesn't need updating when buckets are deleted from the instance.
+func (b *broker) getBindingGroup(userName, instance, access string, buckets map[string]Bucket) (sgGroup, error) {
+	groupName := bindingGroupName(userName)
+	displayName := bindingGroupDisplayName(userName)
+	policy, err := GenerateS3AccessPolicy(instance, access, buckets)
+	if err != nil {
+		return sgGroup{}, fmt.Errorf("Generating policy failed: %s", err)
+	}
+
+	grp, err := b.sgClient.GetGroupByName(groupName)
+	if err == nil {
+		if !equalPolicies(grp.Policies, policy) || grp.DisplayName != displayName {
+			grp.DisplayName = displayName
+			return b.sgClient.UpdateGroupPolicy(grp, policy)
+		}
+		return grp, nil
+	}
+
+	if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+		return sgGroup{}, fmt.Errorf("Error retrieving group %s: %s", groupName, err)
+	}
+
+	log.Printf("Creating binding group with name: %s", groupName)
+	grp, err = b.sgClient.CreateGroup(groupName, displayName, policy)
+	if err != nil {
+		return sgGroup{}, fmt.Errorf("Group Creation Failed: %s", err)
+	}
+
+	return grp, nil
+}
+
+// Deletes the group of a restricted binding, if there is one
+func (b *broker) deleteBindingGroup(userName string) error {
+	grp, err := b.sgClient.GetGroupByName(bindingGroupName(userName))
+	if err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	log.Printf("Deleting group %s\n", grp.DisplayName)
+	return b.sgClient.DeleteGroup(grp.ID)
+}
+
+// Updates the policies of the existing access level groups of an instance to cover the given buckets
+func (b *broker) updateAccessGroups(instance string, buckets map[string]Bucket) error {
+	for access := range accessGroupSuffixes {
+		grp, err := b.sgClient.GetGroupByName(accessGroupName(instance, access))
+		if err != nil {
+			if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+
+		policy, err := GenerateS3AccessPolicy(instance, access, buckets)
+		if err != nil {
+			return fmt.Errorf("Generating policy failed: %s", err)
+		}
+
+		grp.DisplayName = accessGroupDisplayName(instance, access)
+		if _, err := b.sgClient.UpdateGroupPolicy(grp, policy); err != nil {
+			return fmt.Errorf("Error updating policy of group %s: %s", grp.DisplayName, err)
+		}
+	}
+
+	return nil
+}
+
+// Updates the policies of the groups of bindings restricted to some buckets or prefixes. Those bindings are only known with a state store.
+func (b *broker) updateBindingGroups(rec instanceRecord, buckets map[string]Bucket) error {
+	if b.state == nil {
+		return nil
+	}
+
+	bindings, err := b.state.ListBindings(rec.InstanceID)
+	if err != nil {
+		return fmt.Errorf("Error listing bindings: %s", err)
+	}
+
+	for _, binding := range bindings {
+		params, err := getBindParams(binding.Parameters)
+		if err != nil || !params.scoped() {
+			continue
+		}
+
+		bindBuckets, err := selectBindBuckets(params, buckets)
+		if err != nil {
+			continue
+		}
+
+		userName := strings.ReplaceAll(binding.BindingID, "-", "")
+		if _, err := b.getBindingGroup(userName, rec.GroupName, params.Access, bindBuckets); err != nil {
+			return fmt.Errorf("Error updating group of binding %s: %s", binding.BindingID, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *broker) deleteAccessGroups(instance string) error {
+	for access := range accessGroupSuffixes {
+		grp, err := b.sgClient.GetGroupByName(accessGroupName(instance, access))
+		if err != nil {
+			if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+
+		log.Printf("Deleting group %s\n", grp.DisplayName)
+		if err := b.sgClient.DeleteGroup(grp.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIsBindingGroup(t *testing.T) {
+	instance := "0c3b8d35a9e84b5f9a6e3d4c2b1a0f9e"
+
+	tests := []struct {
+		name string
+		grp  sgGroup
+		want bool
+	}{
+		{"instance group", sgGroup{UniqueName: "group/" + instance, DisplayName: instance}, false},
+		{"named instance group", sgGroup{UniqueName: "group/" + instance, DisplayName: "cloudfoundry: org/space/bucket"}, false},
+		{"access group", sgGroup{UniqueName: "group/" + accessGroupName(instance, accessReadOnly), DisplayName: accessGroupDisplayName(instance, accessReadOnly)}, true},
+		{"binding group", sgGroup{UniqueName: "group/" + bindingGroupName(instance), DisplayName: bindingGroupDisplayName(instance)}, true},
+		{"instance named like a marked group", sgGroup{UniqueName: "group/" + instance, DisplayName: parsePlatformContext(json.RawMessage(`{"organization_name": "[binding] org", "instance_name": "x"}`)).displayName(instance)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBindingGroup(tt.grp); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectBindBuckets(t *testing.T) {
+	buckets := map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-2"}}
+
+	tests := []struct {
+		name     string
+		params   BindParameters
+		want     string
+		prefixes []string //of bucket a
+		wantErr  bool
+	}{
+		{"all buckets", BindParameters{}, "a,b", nil, false},
+		{"some buckets", BindParameters{Buckets: []string{"b"}}, "b", nil, false},
+		{"prefixes", BindParameters{Prefixes: map[string][]string{"a": {"logs/"}}}, "a,b", []string{"logs/"}, false},
+		{"unknown bucket", BindParameters{Buckets: []string{"c"}}, "", nil, true},
+		{"prefix outside binding", BindParameters{Buckets: []string{"b"}, Prefixes: map[string][]string{"a": {"logs/"}}}, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := selectBindBuckets(tt.params, buckets)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := keys(selected); got != tt.want {
+				t.Errorf("got buckets %q, want %q", got, tt.want)
+			}
+			if got := selected["a"].prefixes; len(got) != len(tt.prefixes) || (len(got) > 0 && got[0] != tt.prefixes[0]) {
+				t.Errorf("got prefixes %v, want %v", got, tt.prefixes)
+			}
+			if len(buckets["a"].prefixes) > 0 {
+				t.Error("the prefixes were set on the buckets of the instance")
+			}
+		})
+	}
+}
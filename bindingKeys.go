@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// Returns the stored binding when Bind is repeated with identical parameters so the same credentials can be returned.
+// Returns nil when there is no (usable) earlier binding and ErrBindingAlreadyExists when the binding exists with other parameters.
+// Without a binding store the credentials of a recorded binding can't be returned again, a repeated bind is refused rather than
+// replacing the keys handed out before.
+func (b *broker) existingBinding(instanceID, bindingID string, rawParams json.RawMessage) (*storedBinding, error) {
+	if b.state != nil {
+		rec, err := b.state.GetBinding(bindingID)
+		if err == nil {
+			if rec.InstanceID != instanceID || !sameBindParameters(rec.Parameters, rawParams) {
+				return nil, apiresponses.ErrBindingAlreadyExists
+			}
+			if b.bindings == nil {
+				return nil, errBindingNotRetrievable
+			}
+		} else if err != errKeyNotFound {
+			return nil, fmt.Errorf("Error retrieving binding %s from state store: %s", bindingID, err)
+		}
+	}
+
+	if b.bindings == nil {
+		return nil, nil
+	}
+
+	stored, err := b.bindings.Get(bindingID)
+	if err != nil {
+		if err == errKeyNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error retrieving binding %s from binding store: %s", bindingID, err)
+	}
+
+	if stored.InstanceID != instanceID || !sameBindParameters(stored.Parameters, rawParams) {
+		return nil, apiresponses.ErrBindingAlreadyExists
+	}
+
+	//the credentials are useless when the user is gone, in that case the binding is created again
+	user, err := b.sgClient.GetUserByName(strings.ReplaceAll(bindingID, "-", ""))
+	if err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Error retrieving user for binding %s: %s", bindingID, err)
+	}
+
+	//the credentials are useless as well when their key was deleted or has expired
+	keys, err := b.sgClient.ListS3CredsForUser(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing keys of user %s: %s", user.ID, err)
+	}
+
+	keyID := liveKeyID(keys, stored.KeyID, stored.Credentials.AccessKeyID, time.Now())
+	if keyID == "" {
+		log.Printf("The key of binding %s no longer exists or has expired, issuing new keys", bindingID)
+		return nil, nil
+	}
+
+	if err := b.revokeSupersededKeys(user.ID, keyID); err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+var errBindingNotRetrievable = apiresponses.NewFailureResponse(
+	fmt.Errorf("The binding already exists. Its credentials can't be returned again because the broker has no binding store configured"),
+	http.StatusConflict, "binding-already-exists")
+
+// Compares the parameters of two bind requests after defaults are applied
+func sameBindParameters(a, b json.RawMessage) bool {
+	paramsA, err := getBindParams(a)
+	if err != nil {
+		return false
+	}
+
+	paramsB, err := getBindParams(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(paramsA, paramsB)
+}
+
+// Returns the ID of the key with the given ID or, for bindings stored without one, the given access key.
+// Returns an empty string when the user has no such key or it has expired.
+func liveKeyID(keys []sgS3Cred, keyID, accessKey string, now time.Time) string {
+	for _, key := range keys {
+		if keyID != "" && key.ID != keyID || keyID == "" && key.AccessKey != accessKey {
+			continue
+		}
+
+		if expires, err := time.Parse(time.RFC3339, key.Expires); err == nil && !expires.After(now) {
+			return ""
+		}
+
+		return key.ID
+	}
+
+	return ""
+}
+
+// Deletes all keys of a user except the current one. Keys are left behind when a bind is retried after the key was already created.
+func (b *broker) revokeSupersededKeys(userID, currentKeyID string) error {
+	keys, err := b.sgClient.ListS3CredsForUser(userID)
+	if err != nil {
+		return fmt.Errorf("Error listing keys of user %s: %s", userID, err)
+	}
+
+	for _, key := range keys {
+		if key.ID == currentKeyID {
+			continue
+		}
+
+		log.Printf("Revoking superseded key %s of user %s", key.ID, userID)
+		if err := b.sgClient.DeleteS3CredsForUser(userID, key.ID); err != nil {
+			return fmt.Errorf("Error revoking key %s of user %s: %s", key.ID, userID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+func TestExistingBindingWithoutBindingStore(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{state: NewStateStore(backend)}
+
+	err = b.state.PutBinding(bindingRecord{
+		BindingID:  "binding",
+		InstanceID: "instance",
+		Parameters: json.RawMessage(`{"access": "read-only"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		instanceID string
+		bindingID  string
+		params     string
+		wantErr    error
+	}{
+		{"new binding", "instance", "other", `{"access": "read-only"}`, nil},
+		{"identical repeat", "instance", "binding", `{"access": "read-only"}`, errBindingNotRetrievable},
+		{"other parameters", "instance", "binding", `{}`, apiresponses.ErrBindingAlreadyExists},
+		{"other instance", "other", "binding", `{"access": "read-only"}`, apiresponses.ErrBindingAlreadyExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing, err := b.existingBinding(tt.instanceID, tt.bindingID, json.RawMessage(tt.params))
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if existing != nil {
+				t.Errorf("got stored binding %+v, there is no binding store", existing)
+			}
+		})
+	}
+}
+
+func TestSameBindParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", `{"access": "read-only"}`, `{"access": "read-only"}`, true},
+		{"default access", `{}`, `{"access": "read-write"}`, true},
+		{"other access", `{}`, `{"access": "read-only"}`, false},
+		{"invalid", `{"access": "none"}`, `{"access": "none"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameBindParameters(json.RawMessage(tt.a), json.RawMessage(tt.b)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiveKeyID(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := []sgS3Cred{
+		{ID: "current", AccessKey: "AK1"},
+		{ID: "expiring", AccessKey: "AK2", Expires: "2024-06-01T00:00:00.000Z"},
+		{ID: "expired", AccessKey: "AK3", Expires: "2023-06-01T00:00:00.000Z"},
+	}
+
+	tests := []struct {
+		name      string
+		keyID     string
+		accessKey string
+		want      string
+	}{
+		{"by key id", "current", "", "current"},
+		{"by access key", "", "AK1", "current"},
+		{"not yet expired", "expiring", "AK2", "expiring"},
+		{"expired", "expired", "AK3", ""},
+		{"deleted key", "deleted", "AK1", ""},
+		{"unknown access key", "", "AK9", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := liveKeyID(keys, tt.keyID, tt.accessKey, now); got != tt.want {
+				t.Errorf("got key %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
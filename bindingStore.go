@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// bindingStore keeps the credentials handed out for each binding. StorageGrid never returns a secret key twice so this is the only way to make bindings retrievable.
+// All records are encrypted with AES-GCM using a key derived from the configured binding store key.
+type bindingStore struct {
+	db   kvBackend
+	aead cipher.AEAD
+}
+
+type storedBinding struct {
+	InstanceID  string           `json:"instance_id"`
+	Credentials Credentials      `json:"credentials"`
+	Parameters  json.RawMessage  `json:"parameters,omitempty"`
+	KeyID       string           `json:"key_id,omitempty"`
+	Metadata    *bindingMetadata `json:"metadata,omitempty"`
+}
+
+func NewBindingStore(db kvBackend, key string) (*bindingStore, error) {
+	if key == "" {
+		return nil, fmt.Errorf("A binding store key is required to encrypt the binding store")
+	}
+
+	aesKey := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(aesKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("Error creating cipher: %s", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating cipher: %s", err)
+	}
+
+	return &bindingStore{
+		db:   db,
+		aead: aead,
+	}, nil
+}
+
+func (s *bindingStore) Put(bindingID string, binding storedBinding) error {
+	plaintext, err := json.Marshal(binding)
+	if err != nil {
+		return fmt.Errorf("Error marshalling binding %s: %s", bindingID, err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("Error generating nonce: %s", err)
+	}
+
+	//the binding ID is used as additional data so a record can't be copied to another binding
+	ciphertext := s.aead.Seal(nonce, nonce, plaintext, []byte(bindingID))
+
+	return s.db.Put(bindingID, ciphertext)
+}
+
+func (s *bindingStore) Get(bindingID string) (storedBinding, error) {
+	ciphertext, err := s.db.Get(bindingID)
+	if err != nil {
+		return storedBinding{}, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return storedBinding{}, fmt.Errorf("Stored binding %s is corrupt", bindingID)
+	}
+
+	plaintext, err := s.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(bindingID))
+	if err != nil {
+		return storedBinding{}, fmt.Errorf("Unable to decrypt binding %s: %s", bindingID, err)
+	}
+
+	var binding storedBinding
+	err = json.Unmarshal(plaintext, &binding)
+	if err != nil {
+		return storedBinding{}, fmt.Errorf("Error parsing binding %s: %s", bindingID, err)
+	}
+
+	return binding, nil
+}
+
+func (s *bindingStore) Delete(bindingID string) error {
+	return s.db.Delete(bindingID)
+}
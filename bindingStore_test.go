@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestBindingStore(t *testing.T, key string) (*bindingStore, kvBackend) {
+	db, err := NewFileStore(filepath.Join(t.TempDir(), "bindings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewBindingStore(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, db
+}
+
+func TestBindingStore(t *testing.T) {
+	binding := storedBinding{
+		InstanceID: "instance",
+		Credentials: Credentials{
+			AccessKeyID:     "AK1",
+			SecretAccessKey: "secret",
+			Endpoint:        "s3.example.com",
+			Access:          accessReadOnly,
+		},
+		Parameters: json.RawMessage(`{"access":"read-only"}`),
+		KeyID:      "key",
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		store, _ := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.Get("binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, binding) {
+			t.Errorf("got %+v, want %+v", got, binding)
+		}
+	})
+
+	t.Run("secret is encrypted", func(t *testing.T) {
+		store, db := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := db.Get("binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if json.Valid(raw) {
+			t.Errorf("the binding was stored as plain JSON: %s", raw)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		store, db := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := NewBindingStore(db, "other key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Get("binding"); err == nil {
+			t.Error("a binding was decrypted with the wrong key")
+		}
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		store, db := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := db.Get("binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := append([]byte{}, raw...)
+		tampered[len(tampered)-1] ^= 0x01
+		if err := db.Put("binding", tampered); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.Get("binding"); err == nil {
+			t.Error("a tampered binding was accepted")
+		}
+	})
+
+	t.Run("copied to another binding", func(t *testing.T) {
+		store, db := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := db.Get("binding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("other", raw); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.Get("other"); err == nil {
+			t.Error("a binding copied to another binding ID was accepted")
+		}
+	})
+
+	t.Run("truncated record", func(t *testing.T) {
+		store, db := newTestBindingStore(t, "key")
+		if err := db.Put("binding", []byte{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.Get("binding"); err == nil {
+			t.Error("a truncated binding was accepted")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store, _ := newTestBindingStore(t, "key")
+		if err := store.Put("binding", binding); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.Delete("binding"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("binding"); err != errKeyNotFound {
+			t.Errorf("got error %v after delete, want %v", err, errKeyNotFound)
+		}
+	})
+}
+
+func TestNewBindingStoreRequiresKey(t *testing.T) {
+	db, err := NewFileStore(filepath.Join(t.TempDir(), "bindings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewBindingStore(db, ""); err == nil {
+		t.Error("a binding store was created without a key")
+	}
+}
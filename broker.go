@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 
@@ -14,19 +16,31 @@ import (
 	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
 )
 
+var errInstanceNotFound = apiresponses.NewFailureResponseBuilder(
+	errors.New("instance does not exist"), http.StatusNotFound, "instance-missing",
+).Build()
+
 type broker struct {
-	services []brokerapi.Service
-	env      brokerConfig
-	sgClient *storageGridClient
-	s3client *s3client
+	services   []brokerapi.Service
+	env        brokerConfig
+	sgClient   *storageGridClient
+	s3client   *s3client
+	operations *operationTracker
+	bindings   *bindingStore
+	state      *stateStore
 }
 
 type CredBucket struct {
-	URI        string `json:"uri"`
-	Name       string `json:"name"`
-	Bucket     string `json:"bucket"`
-	Region     string `json:"region"`
-	Versioning bool   `json:"versioning"`
+	URI              string   `json:"uri"`
+	Name             string   `json:"name"`
+	Bucket           string   `json:"bucket"`
+	Region           string   `json:"region"`
+	Versioning       bool     `json:"versioning"`
+	VersioningStatus string   `json:"versioning_status"`
+	Prefixes         []string `json:"prefixes,omitempty"`
+	Encryption       string   `json:"encryption,omitempty"`
+	Consistency      string   `json:"consistency"`
+	Replication      string   `json:"replication,omitempty"`
 }
 
 type Credentials struct {
@@ -36,12 +50,55 @@ type Credentials struct {
 	Buckets            []CredBucket `json:"buckets"`
 	Endpoint           string       `json:"endpoint"`
 	PathStyleAccess    bool         `json:"pathStyleAccess"`
+	Access             string       `json:"access"`
+	ExpiresAt          string       `json:"expires_at,omitempty"`
+}
+
+type InstanceParamsBucket struct {
+	Name             string                         `json:"name"`
+	Bucket           string                         `json:"bucket"`
+	Region           string                         `json:"region"`
+	Versioning       bool                           `json:"versioning"`
+	VersioningStatus string                         `json:"versioning_status"`
+	ObjectLock       *ProvisionParamsObjectLock     `json:"object_lock,omitempty"`
+	Lifecycle        []ProvisionParamsLifecycleRule `json:"lifecycle,omitempty"`
+	CORS             []ProvisionParamsCORSRule      `json:"cors,omitempty"`
+	Encryption       bool                           `json:"encryption"`
+	Consistency      string                         `json:"consistency"`
+	Replication      string                         `json:"replication,omitempty"`
+}
+
+type InstanceParameters struct {
+	Buckets []InstanceParamsBucket `json:"buckets"`
 }
 
 type Bucket struct {
-	name       string
-	region     string
-	versioning bool
+	name               string
+	region             string
+	versioning         bool
+	suspended          bool     //versioning has been enabled and then suspended
+	prefixes           []string //only used for bindings restricted to prefixes
+	quotaExceeded      bool
+	tags               map[string]string //requested tags, not including the ones managed by the broker
+	objectLock         objectLockConfig
+	lifecycle          []ProvisionParamsLifecycleRule
+	cors               []ProvisionParamsCORSRule
+	encryption         bool   //default encryption with SSE-S3
+	encryptionRequired bool   //uploads without server-side encryption are denied
+	consistency        string //empty for the StorageGRID default
+	replication        string //name of the replication endpoint, empty when the bucket is not mirrored
+}
+
+// Returns the versioning state of a bucket as reported to apps: enabled, suspended or disabled
+func (bckt Bucket) versioningStatus() string {
+	switch {
+	case bckt.versioning:
+		return "enabled"
+	case bckt.suspended:
+		return "suspended"
+	default:
+		return "disabled"
+	}
 }
 
 func (b *broker) Services(context context.Context) ([]brokerapi.Service, error) {
@@ -71,72 +128,238 @@ func (b *broker) Provision(context context.Context, instanceID string, details d
 		createBuckets[bucket.name] = bucket
 	}
 
+	if err := b.validateQuotaParam(details.PlanID, details.RawParameters); err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	b.applyPlanEncryption(details.PlanID, createBuckets)
+
 	policy, err := GenerateS3Policy(groupName, createBuckets)
 	if err != nil {
 		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Generating policy failed: %s", err)
 	}
 
+	rec := instanceRecord{
+		InstanceID:       instanceID,
+		GroupName:        groupName,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Context:          details.RawContext,
+		Parameters:       details.RawParameters,
+	}
+
+	//the org and space GUID fields are deprecated in favour of the context
+	if org, space := cfContextGUIDs(details.RawContext); org != "" {
+		rec.OrganizationGUID = org
+		rec.SpaceGUID = space
+	}
+
+	if !asyncAllowed {
+		err = b.createInstance(b.operations.New(instanceID, operationProvision), rec, policy, createBuckets)
+		if err != nil {
+			return domain.ProvisionedServiceSpec{}, err
+		}
+
+		return domain.ProvisionedServiceSpec{}, nil
+	}
+
+	//When running async we won't be able to report a conflict from the background so check for an existing group first
+	_, err = b.sgClient.GetGroupByName(groupName)
+	if err == nil {
+		return domain.ProvisionedServiceSpec{}, apiresponses.ErrInstanceAlreadyExists
+	}
+	if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Error getting group from storageGrid: %s", err)
+	}
+
+	op := b.operations.Start(instanceID, operationProvision)
+	go b.createInstance(op, rec, policy, createBuckets)
+
+	spec := domain.ProvisionedServiceSpec{
+		IsAsync:       true,
+		AlreadyExists: false,
+		DashboardURL:  "", //TODO set Dashboard URL??
+		OperationData: op.OperationData(),
+	}
+
+	return spec, nil
+}
+
+// Creates the group and buckets for an instance and reports progress on op. Used by both sync and async provisioning.
+func (b *broker) createInstance(op *operation, rec instanceRecord, policy string, createBuckets map[string]Bucket) error {
+	groupName := rec.GroupName
+	for friendlyName := range createBuckets {
+		op.SetBucketStatus(friendlyName, "pending")
+	}
+
+	target := rec
+	target.Buckets = bucketsToRecords(createBuckets)
+	op.SetJournal(target, nil)
+
+	//Every step is recorded so it can be rolled back when a later step fails
+	s := newSaga(op)
+
 	//1. Create a group with appropriate policy first
 	log.Printf("Creating group with name: %s", groupName)
-	grp, err := b.sgClient.CreateGroup(groupName, policy)
+	grp, err := b.sgClient.CreateGroup(groupName, parsePlatformContext(rec.Context).displayName(groupName), policy)
 	if err != nil {
 		if ae, ok := err.(apiError); ok {
 			if ae.statusCode == http.StatusConflict {
-				return domain.ProvisionedServiceSpec{}, apiresponses.ErrInstanceAlreadyExists
+				op.Fail(fmt.Errorf("Instance already exists"))
+				return apiresponses.ErrInstanceAlreadyExists
 			}
 		}
-		return domain.ProvisionedServiceSpec{}, fmt.Errorf("Group Creation Failed: %s", err)
+		err = fmt.Errorf("Group Creation Failed: %s", err)
+		op.Fail(err)
+		return err
 	}
+	s.Done("group", groupName, b.compensateGroup(grp))
 
 	//2. Create buckets
-	var createdBuckets []string
-	var enableVersioningWG sync.WaitGroup
+	var (
+		enableVersioningWG sync.WaitGroup
+		versioningMutex    sync.Mutex
+		versioningErrs     []error
+	)
 
-	for _, bucket := range createBuckets {
+	for friendlyName, bucket := range createBuckets {
 		log.Printf("Creating bucket with name: %s", bucket.name)
-		_, err = b.s3client.CreateBucket(bucket.name, bucket.region)
+		_, err = b.s3client.CreateBucket(bucket.name, bucket.region, bucket.objectLock.enabled())
 		if err != nil {
-			b.sgClient.DeleteGroup(grp.ID)
+			op.SetBucketStatus(friendlyName, fmt.Sprintf("creation failed (%s)", err))
+			enableVersioningWG.Wait()
+			return b.abort(s, fmt.Errorf("Creating bucket %s failed with error: %s", friendlyName, err))
+		}
+		op.SetBucketStatus(friendlyName, "created")
+		s.Done("bucket", bucket.name, b.compensateBucket(bucket.name))
+
+		if bucket.objectLock.enabled() {
+			if err := b.s3client.PutObjectLockConfiguration(bucket.name, bucket.objectLock); err != nil {
+				op.SetBucketStatus(friendlyName, fmt.Sprintf("setting retention failed (%s)", err))
+				enableVersioningWG.Wait()
+				return b.abort(s, fmt.Errorf("Setting the Object Lock retention of bucket %s failed with error: %s", friendlyName, err))
+			}
+			op.SetBucketStatus(friendlyName, "object lock enabled")
+		}
 
-			for _, delBucket := range createdBuckets {
-				b.s3client.DeleteBucket(delBucket)
+		if bucketConfigChanged(Bucket{}, bucket) {
+			if err := b.configureBucket(Bucket{}, bucket); err != nil {
+				op.SetBucketStatus(friendlyName, fmt.Sprintf("configuration failed (%s)", err))
+				enableVersioningWG.Wait()
+				return b.abort(s, fmt.Errorf("Configuring bucket %s failed with error: %s", friendlyName, err))
 			}
-			return domain.ProvisionedServiceSpec{}, fmt.Errorf("Creating bucket failed with error: %s", err)
+			op.SetBucketStatus(friendlyName, "configured")
 		}
 
 		if bucket.versioning {
 			enableVersioningWG.Add(1)
+			op.SetBucketStatus(friendlyName, "enabling versioning")
 
-			go func(bckt Bucket) {
+			go func(friendlyName string, bckt Bucket) {
 				defer enableVersioningWG.Done()
-				err = b.s3client.EnableBucketVersioning(bckt.name)
+				err := b.s3client.EnableBucketVersioning(bckt.name)
 				if err != nil {
 					log.Printf("Enabling versioning on %s failed: %s", bckt.name, err)
+					op.SetBucketStatus(friendlyName, fmt.Sprintf("enabling versioning failed (%s)", err))
+
+					versioningMutex.Lock()
+					versioningErrs = append(versioningErrs, fmt.Errorf("Enabling versioning on %s failed: %s", friendlyName, err))
+					versioningMutex.Unlock()
 				} else {
 					log.Printf("Successfully enabled versioning for bucket: %s", bckt.name)
+					op.SetBucketStatus(friendlyName, "versioning enabled")
 				}
-			}(bucket)
+			}(friendlyName, bucket)
 		}
-
-		createdBuckets = append(createdBuckets, bucket.name)
 	}
 
 	log.Println("Waiting for version enable goroutines to finish...")
 	enableVersioningWG.Wait()
 	log.Println("All done.")
 
-	spec := domain.ProvisionedServiceSpec{
-		IsAsync:       false,
-		AlreadyExists: false,
-		DashboardURL:  "", //TODO set Dashboard URL??
-		OperationData: "",
+	if len(versioningErrs) > 0 {
+		return b.abort(s, combineBucketErrors("Provisioning failed", versioningErrs))
 	}
 
-	return spec, nil
+	//3. Tag the buckets with the platform context
+	if tagErrs := b.tagBuckets(rec, createBuckets); len(tagErrs) > 0 {
+		return b.abort(s, combineBucketErrors("Provisioning failed", tagErrs))
+	}
+
+	//4. Record the instance
+	if err := b.recordInstance(rec, createBuckets); err != nil {
+		return b.abort(s, err)
+	}
+
+	op.Succeed()
+	return nil
 }
 
 func (b *broker) GetInstance(ctx context.Context, instanceID string) (domain.GetInstanceDetailsSpec, error) {
-	return domain.GetInstanceDetailsSpec{}, fmt.Errorf("Instances are not retrievable")
+	instance := strings.ReplaceAll(instanceID, "-", "")
+
+	//an instance that is still being provisioned doesn't exist yet, one that is being updated can't be fetched until the update finishes
+	if opType, running := b.operations.Running(instanceID); running {
+		switch opType {
+		case operationProvision:
+			return domain.GetInstanceDetailsSpec{}, apiresponses.ErrInstanceDoesNotExist
+		case operationUpdate, "":
+			return domain.GetInstanceDetailsSpec{}, apiresponses.ErrConcurrentInstanceAccess
+		}
+	}
+
+	//1. Get Group
+	grp, err := b.sgClient.GetGroupByName(instance)
+	if err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			return domain.GetInstanceDetailsSpec{}, errInstanceNotFound
+		}
+		return domain.GetInstanceDetailsSpec{}, fmt.Errorf("Error getting group from storageGrid: %s", err)
+	}
+
+	//2. get buckets from group policy
+	buckets, err := b.getBucketsFromGroup(grp)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, fmt.Errorf("Error getting buckets for group %s: %s", grp.DisplayName, err)
+	}
+
+	//3. report the effective parameters
+	rec := b.getInstanceRecord(instanceID)
+	if rec.PlanID == "" {
+		rec.ServiceID, rec.PlanID = b.planFromBuckets(buckets)
+	}
+
+	params := InstanceParameters{
+		Buckets: []InstanceParamsBucket{},
+	}
+	for friendlyName, bckt := range buckets {
+		params.Buckets = append(params.Buckets, InstanceParamsBucket{
+			Name:             friendlyName,
+			Bucket:           bckt.name,
+			Region:           bckt.region,
+			Versioning:       bckt.versioning,
+			VersioningStatus: bckt.versioningStatus(),
+			ObjectLock:       bckt.objectLock.params(),
+			Lifecycle:        bckt.lifecycle,
+			CORS:             bckt.cors,
+			Encryption:       bckt.encryption,
+			Consistency:      bckt.consistencyLevel(),
+			Replication:      bckt.replication,
+		})
+	}
+	sort.Slice(params.Buckets, func(i, j int) bool { return params.Buckets[i].Name < params.Buckets[j].Name })
+
+	b.reportInstanceUsage(ctx, instanceID, buckets)
+
+	spec := domain.GetInstanceDetailsSpec{
+		ServiceID:    rec.ServiceID,
+		PlanID:       rec.PlanID,
+		DashboardURL: "",
+		Parameters:   params,
+	}
+
+	return spec, nil
 }
 
 func (b *broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
@@ -163,8 +386,39 @@ func (b *broker) Deprovision(context context.Context, instanceID string, details
 		return domain.DeprovisionServiceSpec{}, fmt.Errorf("Error getting buckets for group %s: %s", grp.DisplayName, err)
 	}
 
+	if b.operations.InProgress(instanceID) {
+		return domain.DeprovisionServiceSpec{}, apiresponses.ErrConcurrentInstanceAccess
+	}
+
+	if err := b.refuseLockedBuckets(buckets); err != nil {
+		return domain.DeprovisionServiceSpec{}, err
+	}
+
+	if !asyncAllowed {
+		err = b.deleteInstance(b.operations.New(instanceID, operationDeprovision), instanceID, grp, buckets)
+		if err != nil {
+			return domain.DeprovisionServiceSpec{}, bucketFailureResponse(err)
+		}
+
+		return domain.DeprovisionServiceSpec{}, nil
+	}
+
+	op := b.operations.Start(instanceID, operationDeprovision)
+	go b.deleteInstance(op, instanceID, grp, buckets)
+
+	return domain.DeprovisionServiceSpec{IsAsync: true, OperationData: op.OperationData()}, nil
+}
+
+// Deletes the buckets and group of an instance and reports progress on op. Used by both sync and async deprovisioning.
+func (b *broker) deleteInstance(op *operation, instanceID string, grp sgGroup, buckets map[string]Bucket) error {
+	instance := strings.ReplaceAll(instanceID, "-", "")
+
+	target := b.getInstanceRecord(instanceID)
+	target.Buckets = bucketsToRecords(buckets)
+	op.SetJournal(target, buckets)
+
 	//3. Delete buckets
-	deletedBuckets, errs := b.deleteBuckets(buckets)
+	deletedBuckets, errs := b.deleteBuckets(op, buckets)
 
 	if len(errs) > 0 {
 		if len(deletedBuckets) > 0 {
@@ -177,38 +431,67 @@ func (b *broker) Deprovision(context context.Context, instanceID string, details
 				//If all buckets were deleted anyways despite the error we'll delete the group and exit successfully
 				log.Printf("Deleting group %s\n", grp.DisplayName)
 				if err := b.sgClient.DeleteGroup(grp.ID); err != nil {
-					return domain.DeprovisionServiceSpec{}, err
+					op.Fail(err)
+					return err
+				}
+				if err := b.deleteAccessGroups(instance); err != nil {
+					op.Fail(err)
+					return err
 				}
-				return domain.DeprovisionServiceSpec{}, nil
+				if err := b.forgetInstance(instance); err != nil {
+					op.Fail(err)
+					return err
+				}
+				op.Succeed()
+				return nil
 			}
 
 			//if not all buckets were deleted we'll have to generate a new policy containing the remaining buckets
 			policy, err := GenerateS3Policy(instance, buckets)
 			if err != nil {
-				return domain.DeprovisionServiceSpec{}, err
+				op.Fail(err)
+				return err
 			}
 
 			_, err = b.sgClient.UpdateGroupPolicy(grp, policy)
 			if err != nil {
 				log.Printf("Error updating group policy: %s\n", err)
 			}
-		}
 
-		var errorString string
-		for _, e := range errs {
-			errorString = fmt.Sprintf("%s -- %s", errorString, e)
+			if err := b.updateAccessGroups(instance, buckets); err != nil {
+				log.Printf("Error updating access group policies: %s\n", err)
+			}
+
+			if err := b.recordInstance(b.getInstanceRecord(instanceID), buckets); err != nil {
+				log.Printf("Error recording instance %s: %s\n", instanceID, err)
+			}
 		}
 
-		return domain.DeprovisionServiceSpec{}, fmt.Errorf("Errors while deleting service instance: %s", errorString)
+		err := combineBucketErrors("Errors while deleting service instance", errs)
+		op.Fail(err)
+		return err
 	}
 
-	//4. Delete group
+	//4. Delete groups
 	log.Printf("Deleting group %s\n", grp.DisplayName)
 	if err := b.sgClient.DeleteGroup(grp.ID); err != nil {
-		return domain.DeprovisionServiceSpec{}, err
+		op.Fail(err)
+		return err
+	}
+
+	if err := b.deleteAccessGroups(instance); err != nil {
+		op.Fail(err)
+		return err
 	}
 
-	return domain.DeprovisionServiceSpec{}, nil
+	//5. Forget the instance
+	if err := b.forgetInstance(instance); err != nil {
+		op.Fail(err)
+		return err
+	}
+
+	op.Succeed()
+	return nil
 }
 
 func (b *broker) Bind(context context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (domain.Binding, error) {
@@ -217,6 +500,39 @@ func (b *broker) Bind(context context.Context, instanceID, bindingID string, det
 
 	log.Printf("Creating binding %s for instance %s", userName, instance)
 
+	//0 a rotated binding gets the same access as its predecessor. The predecessor keeps working until it is unbound.
+	rawParams := details.RawParameters
+	predecessorID := predecessorBindingID(context)
+	if predecessorID != "" {
+		log.Printf("Binding %s rotates binding %s", userName, predecessorID)
+
+		var err error
+		rawParams, err = b.predecessorParameters(instanceID, predecessorID, details.RawParameters)
+		if err != nil {
+			return domain.Binding{}, err
+		}
+	}
+
+	params, err := getBindParams(rawParams)
+	if err != nil {
+		return domain.Binding{}, err
+	}
+
+	//0b a repeated bind returns the credentials handed out before
+	existing, err := b.existingBinding(instanceID, bindingID, rawParams)
+	if err != nil {
+		return domain.Binding{}, err
+	}
+	if existing != nil {
+		log.Printf("Binding %s already exists", userName)
+		setBindingMetadata(context, existing.Metadata)
+
+		return domain.Binding{
+			AlreadyExists: true,
+			Credentials:   existing.Credentials,
+		}, nil
+	}
+
 	//1a retrieve group
 	group, err := b.sgClient.GetGroupByName(instance)
 	if err != nil {
@@ -229,57 +545,161 @@ func (b *broker) Bind(context context.Context, instanceID, bindingID string, det
 		return domain.Binding{}, fmt.Errorf("Unable to retrieve buckets for instance %s", instance)
 	}
 
+	//2b restrict the binding to the requested buckets and prefixes
+	buckets, err = selectBindBuckets(params, buckets)
+	if err != nil {
+		return domain.Binding{}, err
+	}
+
+	//2c retrieve (or create) the group for the requested access level or, when restricted to some buckets or prefixes, a group for this binding only
+	var accessGroup sgGroup
+	if params.scoped() {
+		accessGroup, err = b.getBindingGroup(userName, instance, params.Access, buckets)
+	} else {
+		accessGroup, err = b.getAccessGroup(group, instance, params.Access, buckets)
+	}
+	if err != nil {
+		return domain.Binding{}, fmt.Errorf("Unable to retrieve %s group for binding %s: %s", params.Access, userName, err)
+	}
+
 	//3 Create storage grid user in group
 	userFullName := fmt.Sprintf("Binding to app GUID: %s", details.AppGUID)
 	if details.AppGUID == "" {
 		userFullName = fmt.Sprintf("Service Key")
 	}
 
-	user, err := b.sgClient.CreateUser(userName, userFullName, []string{group.ID})
+	existingUser := false
+	user, err := b.sgClient.CreateUser(userName, userFullName, []string{accessGroup.ID})
 	if err != nil {
 		if ae, ok := err.(apiError); ok {
 			if ae.statusCode != 409 {
 				return domain.Binding{}, err
 			} else {
-				user, _ = b.sgClient.GetUserByName(userName)
+				user, err = b.sgClient.GetUserByName(userName)
+				if err != nil {
+					return domain.Binding{}, fmt.Errorf("Error retrieving existing user %s: %s", userName, err)
+				}
+				existingUser = true
 			}
 		} else {
 			return domain.Binding{}, err
 		}
 	}
 
-	//4 generate permanent creds for user
-	creds, err := b.sgClient.CreateS3CredsForUser(user.ID)
+	//4 generate creds for user. They expire when a lifetime is configured for this kind of binding
+	expiresAt := b.bindingExpiry(details.AppGUID)
+	creds, err := b.sgClient.CreateS3CredsForUser(user.ID, expiresAt)
+	if err != nil {
+		return domain.Binding{}, fmt.Errorf("Error creating keys for user %s: %s", userName, err)
+	}
+
+	//4b the user is left over from an earlier attempt whose credentials weren't kept. Only the new key remains valid.
+	if existingUser {
+		if err := b.revokeSupersededKeys(user.ID, creds.ID); err != nil {
+			return domain.Binding{}, err
+		}
+	}
 
 	//5. return bind info
 	credBuckets := []CredBucket{}
 	for friendlyName, bckt := range buckets {
 		cb := CredBucket{
-			URI:        fmt.Sprintf("s3://%s:%s@%s/%s", url.QueryEscape(creds.AccessKey), url.QueryEscape(creds.SecretAccessKey), b.s3client.Endpoint, bckt.name),
-			Name:       friendlyName,
-			Bucket:     bckt.name,
-			Region:     bckt.region,
-			Versioning: bckt.versioning,
+			URI:              fmt.Sprintf("s3://%s:%s@%s/%s", url.QueryEscape(creds.AccessKey), url.QueryEscape(creds.SecretAccessKey), b.s3client.Endpoint, bckt.name),
+			Name:             friendlyName,
+			Bucket:           bckt.name,
+			Region:           bckt.region,
+			Versioning:       bckt.versioning,
+			VersioningStatus: bckt.versioningStatus(),
+			Prefixes:         bckt.prefixes,
+			Encryption:       bckt.encryptionName(),
+			Consistency:      bckt.consistencyLevel(),
+			Replication:      bckt.replication,
 		}
 		credBuckets = append(credBuckets, cb)
 	}
 
+	bindCreds := Credentials{
+		InsecureSkipVerify: b.env.StorageGridSkipSSLCheck,
+		AccessKeyID:        creds.AccessKey,
+		SecretAccessKey:    creds.SecretAccessKey,
+		Buckets:            credBuckets,
+		Endpoint:           b.s3client.Endpoint,
+		PathStyleAccess:    b.env.S3ForcePathStyle,
+		Access:             params.Access,
+	}
+
+	metadata := b.newBindingMetadata(expiresAt)
+	if metadata != nil {
+		bindCreds.ExpiresAt = metadata.ExpiresAt
+	}
+
+	//6. record the binding and keep the credentials so the binding can be retrieved later on
+	if b.state != nil {
+		err = b.state.PutBinding(bindingRecord{
+			BindingID:            bindingID,
+			InstanceID:           instanceID,
+			UserName:             userName,
+			AppGUID:              details.AppGUID,
+			PredecessorBindingID: predecessorID,
+			KeyID:                creds.ID,
+			Context:              details.RawContext,
+			Parameters:           rawParams,
+		})
+		if err != nil {
+			return domain.Binding{}, fmt.Errorf("Error recording binding %s: %s", bindingID, err)
+		}
+	}
+
+	if b.bindings != nil {
+		err = b.bindings.Put(bindingID, storedBinding{
+			InstanceID:  instanceID,
+			Credentials: bindCreds,
+			Parameters:  rawParams,
+			KeyID:       creds.ID,
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return domain.Binding{}, fmt.Errorf("Error storing binding %s: %s", bindingID, err)
+		}
+	}
+
+	setBindingMetadata(context, metadata)
+
 	binding := domain.Binding{
-		Credentials: Credentials{
-			InsecureSkipVerify: b.env.StorageGridSkipSSLCheck,
-			AccessKeyID:        creds.AccessKey,
-			SecretAccessKey:    creds.SecretAccessKey,
-			Buckets:            credBuckets,
-			Endpoint:           b.s3client.Endpoint,
-			PathStyleAccess:    b.env.S3ForcePathStyle,
-		},
+		Credentials: bindCreds,
 	}
 
 	return binding, nil
 }
 
 func (b *broker) GetBinding(ctx context.Context, instanceID, bindingID string) (domain.GetBindingSpec, error) {
-	return domain.GetBindingSpec{}, fmt.Errorf("Bindings are not retrievable")
+	if b.bindings == nil {
+		return domain.GetBindingSpec{}, fmt.Errorf("Bindings are not retrievable")
+	}
+
+	binding, err := b.bindings.Get(bindingID)
+	if err != nil {
+		if err == errKeyNotFound {
+			return domain.GetBindingSpec{}, apiresponses.ErrBindingNotFound
+		}
+		return domain.GetBindingSpec{}, err
+	}
+
+	if binding.InstanceID != instanceID {
+		return domain.GetBindingSpec{}, apiresponses.ErrBindingNotFound
+	}
+
+	spec := domain.GetBindingSpec{
+		Credentials: binding.Credentials,
+	}
+
+	if len(binding.Parameters) > 0 {
+		spec.Parameters = binding.Parameters
+	}
+
+	setBindingMetadata(ctx, binding.Metadata)
+
+	return spec, nil
 }
 
 func (b *broker) Unbind(context context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (domain.UnbindSpec, error) {
@@ -290,16 +710,35 @@ func (b *broker) Unbind(context context.Context, instanceID, bindingID string, d
 	//1. delete user
 	user, err := b.sgClient.GetUserByName(userName)
 	if err != nil {
-		//if user was never created or already gone return succes
-		if strings.Contains(err.Error(), "404") {
-			return domain.UnbindSpec{}, nil
+		//if user was never created or already gone we only have to clean up the stored credentials
+		if !strings.Contains(err.Error(), "404") {
+			return domain.UnbindSpec{}, err
 		}
-		return domain.UnbindSpec{}, err
+	} else {
+		err = b.sgClient.DeleteUser(user.ID)
+		if err != nil {
+			return domain.UnbindSpec{}, err
+		}
+	}
+
+	if err := b.deleteBindingGroup(userName); err != nil {
+		return domain.UnbindSpec{}, fmt.Errorf("Error deleting group of binding %s: %s", userName, err)
 	}
 
-	err = b.sgClient.DeleteUser(user.ID)
+	//2. forget the binding and stored credentials
+	if b.state != nil {
+		if err := b.state.DeleteBinding(bindingID); err != nil {
+			return domain.UnbindSpec{}, fmt.Errorf("Error removing binding %s from state store: %s", bindingID, err)
+		}
+	}
+
+	if b.bindings != nil {
+		if err := b.bindings.Delete(bindingID); err != nil {
+			return domain.UnbindSpec{}, fmt.Errorf("Error removing binding %s from binding store: %s", bindingID, err)
+		}
+	}
 
-	return domain.UnbindSpec{}, err
+	return domain.UnbindSpec{}, nil
 }
 
 func (b *broker) Update(context context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
@@ -315,115 +754,196 @@ func (b *broker) Update(context context.Context, instanceID string, details doma
 		return domain.UpdateServiceSpec{}, fmt.Errorf("Unable to retrieve buckets for instance %s", instance)
 	}
 
-	// get reqbuckets
+	// get reqbuckets. Without parameters (a rename only sends the context) the buckets are kept as they are.
 	requestedBuckets := make(map[string]Bucket)
-	if details.RawParameters != nil && len(details.RawParameters) > 0 {
+	if len(details.RawParameters) > 0 {
 		requestedBuckets, err = b.getRequestedBucketsFromParams(details.RawParameters)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
 	} else {
-		return domain.UpdateServiceSpec{}, apiresponses.ErrRawParamsInvalid
+		for friendlyName, bckt := range currentBuckets {
+			requestedBuckets[friendlyName] = bckt
+		}
 	}
+	rec := b.getInstanceRecord(instanceID)
+	rec.PlanID = updatedPlanID(details, rec)
+	b.applyPlanEncryption(rec.PlanID, requestedBuckets)
 
-	// figure out which ones to delete range over current, if you can't find it in req then on delete list. While we're at it let's also find out which buckets to change the versioning setting on
-	deleteList := make(map[string]Bucket)
-	enableVersioningList := make(map[string]Bucket)
-	for key, bckt := range currentBuckets {
-		if _, ok := requestedBuckets[key]; !ok {
-			deleteList[key] = bckt
-		} else {
-			if bckt.versioning == false && requestedBuckets[key].versioning == true { //can't simply check if changed because we cannot disable versioning
-				enableVersioningList[key] = bckt
-			}
-		}
+	if b.operations.InProgress(instanceID) {
+		return domain.UpdateServiceSpec{}, apiresponses.ErrConcurrentInstanceAccess
 	}
 
-	// figure out which ones to create. range over req, if you can't find it in current then on create list
-	createList := make(map[string]Bucket)
-	for friendlyName, bckt := range requestedBuckets {
-		if _, ok := currentBuckets[friendlyName]; !ok {
-			//if it's not in current bucket list we'll generate a new name and add it to the create list
-			bckt.name = generatNewFullName(friendlyName)
-			createList[friendlyName] = bckt
-		}
+	// figure out what to delete, create and change
+	changes, err := planBucketChanges(currentBuckets, requestedBuckets)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
 	}
 
-	//delete buckets and remove deleted buckets from currentlist
-	deletedBuckets, delErr := b.deleteBuckets(deleteList)
-	for friendlyName := range deletedBuckets {
-		delete(currentBuckets, friendlyName)
+	if err := b.refuseLockedBuckets(changes.delete); err != nil {
+		return domain.UpdateServiceSpec{}, err
 	}
 
-	//create buckets and add created buckets to current list
-	var createErr []error
-	for friendlyName, bucket := range createList {
-		log.Printf("Creating bucket with name: %s", bucket.name)
-		_, err = b.s3client.CreateBucket(bucket.name, bucket.region)
-		if err != nil {
-			createErr = append(createErr, err)
-		} else {
-			currentBuckets[friendlyName] = bucket
+	if len(details.RawParameters) > 0 {
+		rec.Parameters = details.RawParameters
+	}
+	if err := b.validateQuotaParam(rec.PlanID, rec.Parameters); err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if len(details.RawContext) > 0 {
+		rec.Context = details.RawContext
+	}
+	if org, space := cfContextGUIDs(details.RawContext); org != "" {
+		rec.OrganizationGUID = org
+		rec.SpaceGUID = space
+	}
 
-			if bucket.versioning {
-				enableVersioningList[friendlyName] = bucket
-			}
+	if !asyncAllowed {
+		err = b.updateInstance(b.operations.New(instanceID, operationUpdate), rec, group, changes)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, bucketFailureResponse(err)
 		}
+
+		return domain.UpdateServiceSpec{}, nil
 	}
 
-	//enable versioning on buckets from enableVerisoningList
-	var enableVerWG sync.WaitGroup
-	enableVerWG.Add(len(enableVersioningList))
+	op := b.operations.Start(instanceID, operationUpdate)
+	go b.updateInstance(op, rec, group, changes)
 
-	for _, bucket := range enableVersioningList {
-		//we'll run enabling versioning in parallel because it seems to take some time (more than 5 seconds per buckets).
-		go func(bckt Bucket) {
-			defer enableVerWG.Done()
+	spec := domain.UpdateServiceSpec{
+		IsAsync:       true,
+		DashboardURL:  "",
+		OperationData: op.OperationData(),
+	}
+	return spec, nil
+}
 
-			err := b.s3client.EnableBucketVersioning(bckt.name)
-			if err != nil {
-				log.Printf("Enabling versioning on %s failed: %s", bckt.name, err)
-			} else {
-				log.Printf("Successfully enabled versioning for bucket: %s", bckt.name)
-			}
-		}(bucket)
+// Returns the plan of the instance after the update. plan_id is optional, without it the plan doesn't change.
+func updatedPlanID(details domain.UpdateDetails, rec instanceRecord) string {
+	if details.PlanID != "" {
+		return details.PlanID
+	}
+	if rec.PlanID != "" {
+		return rec.PlanID
 	}
 
-	log.Println("Waiting for version enable goroutines to finish...")
-	enableVerWG.Wait()
-	log.Println("All done.")
+	return details.PreviousValues.PlanID
+}
+
+// Applies the changes calculated by Update and reports progress on op. Used by both sync and async updates.
+func (b *broker) updateInstance(op *operation, rec instanceRecord, group sgGroup, changes bucketChanges) error {
+	instance := rec.GroupName
+	currentBuckets := changes.current
+
+	for friendlyName := range changes.create {
+		op.SetBucketStatus(friendlyName, "pending")
+	}
+
+	//journal the buckets the instance should end up with
+	target := rec
+	target.Buckets = bucketsToRecords(changes.target())
+	op.SetJournal(target, changes.delete)
+
+	//delete buckets and remove deleted buckets from currentlist
+	deletedBuckets, errs := b.deleteBuckets(op, changes.delete)
+	for friendlyName := range deletedBuckets {
+		delete(currentBuckets, friendlyName)
+	}
+
+	//create buckets and add created buckets to current list
+	errs = append(errs, b.createBuckets(op, changes)...)
+
+	//change the existing and new buckets. Failures are collected and reported once the instance has been recorded.
+	//versioning is suspended last: StorageGRID refuses while the bucket is still mirrored, and the configuration may turn that off.
+	errs = append(errs, b.enableVersioning(op, changes)...)
+	errs = append(errs, b.applyObjectLock(op, changes)...)
+	errs = append(errs, b.applyConfiguration(op, changes)...)
+	errs = append(errs, b.suspendVersioning(op, changes)...)
+
+	errs = append(errs, b.applyTags(rec, changes)...)
 
 	//generate the policy to include changes
 	policy, err := GenerateS3Policy(instance, currentBuckets)
 	if err != nil {
-		return domain.UpdateServiceSpec{}, fmt.Errorf("Generating policy failed: %s", err)
+		err = fmt.Errorf("Generating policy failed: %s", err)
+		op.Fail(err)
+		return err
+	}
+	//keep the current display name when the platform didn't send names
+	if pc := parsePlatformContext(rec.Context); pc.InstanceName != "" {
+		group.DisplayName = pc.displayName(instance)
 	}
 	_, err = b.s3client.SgClient.UpdateGroupPolicy(group, policy)
 	if err != nil {
-		return domain.UpdateServiceSpec{}, err
+		op.Fail(err)
+		return err
 	}
 
-	//check for accumulated errors
-	var errString string
-	if len(createErr) > 0 || len(delErr) > 0 {
-		for _, e := range createErr {
-			errString = fmt.Sprintf("%s-%s", errString, e.Error())
-		}
+	if err := b.updateAccessGroups(instance, currentBuckets); err != nil {
+		err = fmt.Errorf("Error updating access group policies: %s", err)
+		op.Fail(err)
+		return err
+	}
 
-		for _, e := range delErr {
-			errString = fmt.Sprintf("%s-%s", errString, e.Error())
-		}
+	//scoped bindings have their own groups, their policies also change with the plan (encryption) and the buckets
+	if err := b.updateBindingGroups(rec, currentBuckets); err != nil {
+		op.Fail(err)
+		return err
+	}
 
-		return domain.UpdateServiceSpec{}, fmt.Errorf("Errors occured while updating service: %s", errString)
+	//record the buckets the instance has now, even if some changes failed
+	if err := b.recordInstance(rec, currentBuckets); err != nil {
+		op.Fail(err)
+		return err
 	}
 
-	spec := domain.UpdateServiceSpec{
-		IsAsync:       false,
-		DashboardURL:  "",
-		OperationData: "",
+	//check for accumulated errors
+	if len(errs) > 0 {
+		err = combineBucketErrors("Errors occured while updating service", errs)
+		op.Fail(err)
+		return err
 	}
-	return spec, nil
+
+	op.Succeed()
+	return nil
 }
 
 func (b *broker) LastOperation(context context.Context, instanceID string, details domain.PollDetails) (brokerapi.LastOperation, error) {
-	return brokerapi.LastOperation{}, nil
+	if lastOp, ok := b.operations.LastOperation(instanceID, details.OperationData); ok {
+		return lastOp, nil
+	}
+
+	//The operation might be running on another broker instance (or this one was restarted). In that case derive the state from storageGrid.
+	opType := operationType(strings.SplitN(details.OperationData, ":", 2)[0])
+
+	instance := strings.ReplaceAll(instanceID, "-", "")
+	grp, err := b.sgClient.GetGroupByName(instance)
+	if err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			if opType == operationDeprovision {
+				return brokerapi.LastOperation{State: domain.Succeeded, Description: "Instance deleted"}, nil
+			}
+			return brokerapi.LastOperation{State: domain.Failed, Description: "Instance not found"}, nil
+		}
+		return brokerapi.LastOperation{}, fmt.Errorf("Error getting group from storageGrid: %s", err)
+	}
+
+	buckets, err := b.getBucketsFromGroup(grp)
+	if err != nil {
+		return brokerapi.LastOperation{}, fmt.Errorf("Error getting buckets for group %s: %s", grp.DisplayName, err)
+	}
+
+	if opType == operationDeprovision {
+		return brokerapi.LastOperation{State: domain.InProgress, Description: fmt.Sprintf("%d buckets left to delete", len(buckets))}, nil
+	}
+
+	for friendlyName, bckt := range buckets {
+		if bckt.region == "" { //bucket is in the policy but not (yet) in S3
+			return brokerapi.LastOperation{State: domain.InProgress, Description: fmt.Sprintf("Waiting for bucket %s", friendlyName)}, nil
+		}
+	}
+
+	return brokerapi.LastOperation{State: domain.Succeeded}, nil
 }
 
 func (b *broker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, details domain.PollDetails) (domain.LastOperation, error) {
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// bucketChanges is the plan Update calculates once to turn the current buckets of an instance into the requested ones. All maps are keyed by friendly name.
+// While the plan is applied current is kept up to date with what has actually been changed, so it can be recorded even when some changes fail.
+type bucketChanges struct {
+	current           map[string]Bucket
+	delete            map[string]Bucket
+	create            map[string]Bucket //with a newly generated bucket name
+	enableVersioning  map[string]Bucket
+	suspendVersioning map[string]Bucket
+	objectLock        map[string]Bucket            //buckets with their new retention
+	configure         map[string]Bucket            //buckets with their new configuration
+	tags              map[string]map[string]string //requested tags of the buckets that are kept, they're set on every update
+}
+
+// Compares the current buckets of an instance with the requested ones. Fails when a requested change is not allowed.
+func planBucketChanges(current, requested map[string]Bucket) (bucketChanges, error) {
+	changes := bucketChanges{
+		current:           current,
+		delete:            make(map[string]Bucket),
+		create:            make(map[string]Bucket),
+		enableVersioning:  make(map[string]Bucket),
+		suspendVersioning: make(map[string]Bucket),
+		objectLock:        make(map[string]Bucket),
+		configure:         make(map[string]Bucket),
+		tags:              make(map[string]map[string]string),
+	}
+
+	for friendlyName, bckt := range current {
+		req, ok := requested[friendlyName]
+		if !ok {
+			changes.delete[friendlyName] = bckt
+			continue
+		}
+
+		//versioning can't be disabled once it has been enabled, only suspended. Buckets with Object Lock always request versioning.
+		if !bckt.versioning && req.versioning {
+			changes.enableVersioning[friendlyName] = bckt
+		} else if bckt.versioning && !req.versioning {
+			changes.suspendVersioning[friendlyName] = bckt
+		}
+
+		if err := checkObjectLockChange(friendlyName, bckt.objectLock, req.objectLock); err != nil {
+			return bucketChanges{}, err
+		}
+		if req.objectLock != bckt.objectLock {
+			locked := bckt
+			locked.objectLock = req.objectLock
+			changes.objectLock[friendlyName] = locked
+		}
+
+		if bucketConfigChanged(bckt, req) {
+			changes.configure[friendlyName] = withBucketConfig(bckt, req)
+		}
+
+		changes.tags[friendlyName] = req.tags
+	}
+
+	for friendlyName, bckt := range requested {
+		if _, ok := current[friendlyName]; !ok {
+			bckt.name = generatNewFullName(friendlyName)
+			changes.create[friendlyName] = bckt
+		}
+	}
+
+	return changes, nil
+}
+
+// Returns the buckets the instance ends up with when all changes succeed
+func (c bucketChanges) target() map[string]Bucket {
+	target := make(map[string]Bucket)
+	for friendlyName, bckt := range c.current {
+		if _, ok := c.delete[friendlyName]; !ok {
+			target[friendlyName] = bckt
+		}
+	}
+	for friendlyName, bckt := range c.create {
+		target[friendlyName] = bckt
+	}
+	for friendlyName, bckt := range c.enableVersioning {
+		bckt.versioning = true
+		bckt.suspended = false
+		target[friendlyName] = bckt
+	}
+	for friendlyName, bckt := range c.suspendVersioning {
+		bckt.versioning = false
+		bckt.suspended = true
+		target[friendlyName] = bckt
+	}
+	for friendlyName, bckt := range c.objectLock {
+		t := target[friendlyName]
+		t.objectLock = bckt.objectLock
+		target[friendlyName] = t
+	}
+	for friendlyName, bckt := range c.configure {
+		target[friendlyName] = withBucketConfig(target[friendlyName], bckt)
+	}
+	for friendlyName, tags := range c.tags {
+		t := target[friendlyName]
+		t.tags = tags
+		target[friendlyName] = t
+	}
+
+	return target
+}
+
+// Creates the new buckets. Their retention, configuration and versioning are added to the other changes so they're applied together with those of the existing buckets.
+func (b *broker) createBuckets(op *operation, changes bucketChanges) []error {
+	var errs []error
+	for friendlyName, bucket := range changes.create {
+		log.Printf("Creating bucket with name: %s", bucket.name)
+		_, err := b.s3client.CreateBucket(bucket.name, bucket.region, bucket.objectLock.enabled())
+		if err != nil {
+			op.SetBucketStatus(friendlyName, fmt.Sprintf("creation failed (%s)", err))
+			errs = append(errs, fmt.Errorf("Error creating bucket %s: %s", bucket.name, err))
+			continue
+		}
+		op.SetBucketStatus(friendlyName, "created")
+
+		//the bucket has Object Lock from now on, the retention is set with the existing buckets
+		if bucket.objectLock.enabled() {
+			changes.objectLock[friendlyName] = bucket
+			bucket.objectLock = objectLockWithoutRetention
+		}
+
+		//same for the configuration
+		if bucketConfigChanged(Bucket{}, bucket) {
+			changes.configure[friendlyName] = bucket
+			bucket = withBucketConfig(bucket, Bucket{})
+		}
+
+		if bucket.versioning {
+			changes.enableVersioning[friendlyName] = bucket
+		}
+
+		//versioning will be set in the current list once it has actually been enabled
+		bucket.versioning = false
+		changes.current[friendlyName] = bucket
+	}
+
+	return errs
+}
+
+// Enables versioning on all buckets in parallel because it seems to take some time (more than 5 seconds per bucket)
+func (b *broker) enableVersioning(op *operation, changes bucketChanges) []error {
+	var (
+		enableVerWG     sync.WaitGroup
+		versioningMutex sync.Mutex
+		errs            []error
+	)
+	enableVerWG.Add(len(changes.enableVersioning))
+
+	for friendlyName, bucket := range changes.enableVersioning {
+		op.SetBucketStatus(friendlyName, "enabling versioning")
+
+		go func(friendlyName string, bckt Bucket) {
+			defer enableVerWG.Done()
+
+			err := b.s3client.EnableBucketVersioning(bckt.name)
+			if err != nil {
+				log.Printf("Enabling versioning on %s failed: %s", bckt.name, err)
+				op.SetBucketStatus(friendlyName, fmt.Sprintf("enabling versioning failed (%s)", err))
+
+				versioningMutex.Lock()
+				errs = append(errs, fmt.Errorf("Enabling versioning on bucket %s failed: %s", friendlyName, err))
+				versioningMutex.Unlock()
+			} else {
+				versioningMutex.Lock()
+				bckt.versioning = true
+				bckt.suspended = false
+				changes.current[friendlyName] = bckt
+				versioningMutex.Unlock()
+
+				log.Printf("Successfully enabled versioning for bucket: %s", bckt.name)
+				op.SetBucketStatus(friendlyName, "versioning enabled")
+			}
+		}(friendlyName, bucket)
+	}
+
+	log.Println("Waiting for version enable goroutines to finish...")
+	enableVerWG.Wait()
+	log.Println("All done.")
+
+	return errs
+}
+
+// Suspends versioning. Existing versions are kept until they're deleted (or expired by a lifecycle rule).
+func (b *broker) suspendVersioning(op *operation, changes bucketChanges) []error {
+	var errs []error
+	for friendlyName, bckt := range changes.suspendVersioning {
+		op.SetBucketStatus(friendlyName, "suspending versioning")
+
+		if err := b.s3client.SuspendBucketVersioning(bckt.name); err != nil {
+			log.Printf("Suspending versioning on %s failed: %s", bckt.name, err)
+			op.SetBucketStatus(friendlyName, fmt.Sprintf("suspending versioning failed (%s)", err))
+			errs = append(errs, fmt.Errorf("Suspending versioning on bucket %s failed: %s", friendlyName, err))
+			continue
+		}
+
+		bckt = changes.current[friendlyName]
+		bckt.versioning = false
+		bckt.suspended = true
+		changes.current[friendlyName] = bckt
+
+		log.Printf("Successfully suspended versioning for bucket: %s", bckt.name)
+		op.SetBucketStatus(friendlyName, "versioning suspended")
+	}
+
+	return errs
+}
+
+// Sets the retention of buckets with Object Lock. planBucketChanges made sure it only gets stricter.
+func (b *broker) applyObjectLock(op *operation, changes bucketChanges) []error {
+	var errs []error
+	for friendlyName, bucket := range changes.objectLock {
+		if _, ok := changes.current[friendlyName]; !ok {
+			continue
+		}
+
+		if err := b.s3client.PutObjectLockConfiguration(bucket.name, bucket.objectLock); err != nil {
+			log.Printf("Setting the Object Lock retention of %s failed: %s", bucket.name, err)
+			op.SetBucketStatus(friendlyName, fmt.Sprintf("setting retention failed (%s)", err))
+			errs = append(errs, fmt.Errorf("Setting the Object Lock retention of bucket %s failed: %s", friendlyName, err))
+			continue
+		}
+
+		bckt := changes.current[friendlyName]
+		bckt.objectLock = bucket.objectLock
+		changes.current[friendlyName] = bckt
+		op.SetBucketStatus(friendlyName, "retention set")
+	}
+
+	return errs
+}
+
+// Sets the requested tags on the kept buckets and tags all buckets again, the context changes when the instance, space or org is renamed
+func (b *broker) applyTags(rec instanceRecord, changes bucketChanges) []error {
+	for friendlyName, tags := range changes.tags {
+		if bckt, ok := changes.current[friendlyName]; ok {
+			bckt.tags = tags
+			changes.current[friendlyName] = bckt
+		}
+	}
+
+	return b.tagBuckets(rec, changes.current)
+}
+
+// Applies the changed bucket configurations
+func (b *broker) applyConfiguration(op *operation, changes bucketChanges) []error {
+	var errs []error
+	for friendlyName, bucket := range changes.configure {
+		if _, ok := changes.current[friendlyName]; !ok {
+			continue
+		}
+
+		if err := b.configureBucket(changes.current[friendlyName], bucket); err != nil {
+			log.Printf("Configuring %s failed: %s", bucket.name, err)
+			op.SetBucketStatus(friendlyName, fmt.Sprintf("configuration failed (%s)", err))
+			errs = append(errs, fmt.Errorf("Configuring bucket %s failed: %s", friendlyName, err))
+			continue
+		}
+
+		changes.current[friendlyName] = withBucketConfig(changes.current[friendlyName], bucket)
+		op.SetBucketStatus(friendlyName, "configured")
+	}
+
+	return errs
+}
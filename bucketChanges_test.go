@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func keys(buckets map[string]Bucket) string {
+	names := []string{}
+	for friendlyName := range buckets {
+		names = append(names, friendlyName)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func TestPlanBucketChanges(t *testing.T) {
+	governance30 := objectLockConfig{mode: "GOVERNANCE", days: 30}
+
+	tests := []struct {
+		name      string
+		current   map[string]Bucket
+		requested map[string]Bucket
+		delete    string
+		create    string
+		enable    string
+		suspend   string
+		lock      string
+		configure string
+		wantErr   bool
+	}{
+		{
+			name:      "nothing changed",
+			current:   map[string]Bucket{"a": {name: "a-1", versioning: true}},
+			requested: map[string]Bucket{"a": {name: "a", versioning: true}},
+		},
+		{
+			name:      "buckets added and removed",
+			current:   map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-1"}},
+			requested: map[string]Bucket{"b": {name: "b"}, "c": {name: "c"}},
+			delete:    "a",
+			create:    "c",
+		},
+		{
+			name:      "versioning enabled and suspended",
+			current:   map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-1", versioning: true}},
+			requested: map[string]Bucket{"a": {name: "a", versioning: true}, "b": {name: "b"}},
+			enable:    "a",
+			suspend:   "b",
+		},
+		{
+			name:      "retention lengthened",
+			current:   map[string]Bucket{"a": {name: "a-1", versioning: true, objectLock: governance30}},
+			requested: map[string]Bucket{"a": {name: "a", versioning: true, objectLock: objectLockConfig{mode: "GOVERNANCE", days: 60}}},
+			lock:      "a",
+		},
+		{
+			name:      "retention shortened",
+			current:   map[string]Bucket{"a": {name: "a-1", versioning: true, objectLock: governance30}},
+			requested: map[string]Bucket{"a": {name: "a", versioning: true, objectLock: objectLockConfig{mode: "GOVERNANCE", days: 10}}},
+			wantErr:   true,
+		},
+		{
+			name:      "object lock on existing bucket",
+			current:   map[string]Bucket{"a": {name: "a-1"}},
+			requested: map[string]Bucket{"a": {name: "a", versioning: true, objectLock: governance30}},
+			wantErr:   true,
+		},
+		{
+			name:      "configuration changed",
+			current:   map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-1", encryption: true}},
+			requested: map[string]Bucket{"a": {name: "a", consistency: "strong-global"}, "b": {name: "b", encryption: true}},
+			configure: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := planBucketChanges(tt.current, tt.requested)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				list    string
+				buckets map[string]Bucket
+				want    string
+			}{
+				{"delete", changes.delete, tt.delete},
+				{"create", changes.create, tt.create},
+				{"enable versioning", changes.enableVersioning, tt.enable},
+				{"suspend versioning", changes.suspendVersioning, tt.suspend},
+				{"object lock", changes.objectLock, tt.lock},
+				{"configure", changes.configure, tt.configure},
+			} {
+				if got := keys(c.buckets); got != c.want {
+					t.Errorf("%s: got %q, want %q", c.list, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketChangesTarget(t *testing.T) {
+	changes, err := planBucketChanges(
+		map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-1", versioning: true}, "c": {name: "c-1"}},
+		map[string]Bucket{"a": {name: "a", versioning: true, encryption: true}, "b": {name: "b"}, "d": {name: "d"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := changes.target()
+	if got := keys(target); got != "a,b,d" {
+		t.Fatalf("target buckets: got %q", got)
+	}
+
+	if a := target["a"]; a.name != "a-1" || !a.versioning || !a.encryption {
+		t.Errorf("bucket a: got %+v", a)
+	}
+	if b := target["b"]; b.versioning || !b.suspended {
+		t.Errorf("bucket b: got %+v", b)
+	}
+	if d := target["d"]; !strings.HasPrefix(d.name, "d-") {
+		t.Errorf("bucket d: got name %s", d.name)
+	}
+}
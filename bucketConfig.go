@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Returns true when the configuration of a bucket (lifecycle and CORS rules, encryption, consistency, replication) has to be applied to turn current into requested.
+// A new bucket is compared with Bucket{}.
+func bucketConfigChanged(current, requested Bucket) bool {
+	return !reflect.DeepEqual(current.lifecycle, requested.lifecycle) || !reflect.DeepEqual(current.cors, requested.cors) ||
+		current.encryption != requested.encryption || current.encryptionRequired != requested.encryptionRequired ||
+		current.consistencyLevel() != requested.consistencyLevel() || current.replication != requested.replication
+}
+
+// Returns the current bucket with the configuration of the requested one
+func withBucketConfig(current, requested Bucket) Bucket {
+	current.lifecycle = requested.lifecycle
+	current.cors = requested.cors
+	current.encryption = requested.encryption
+	current.encryptionRequired = requested.encryptionRequired
+	current.consistency = requested.consistency
+	current.replication = requested.replication
+	return current
+}
+
+// Applies the configuration of a bucket. Settings that are not requested are removed from the bucket.
+// current is the bucket as it is configured now, Bucket{} for a new bucket. Replication is only torn down when current is mirrored.
+func (b *broker) configureBucket(current, bckt Bucket) error {
+	if err := b.s3client.PutBucketLifecycle(bckt.name, bckt.lifecycle); err != nil {
+		return fmt.Errorf("Setting lifecycle rules failed: %s", err)
+	}
+
+	if err := b.s3client.PutBucketCors(bckt.name, bckt.cors); err != nil {
+		return fmt.Errorf("Setting CORS rules failed: %s", err)
+	}
+
+	if err := b.s3client.PutBucketEncryption(bckt.name, bckt.encryption); err != nil {
+		return fmt.Errorf("Setting default encryption failed: %s", err)
+	}
+
+	if err := b.sgClient.SetBucketConsistency(bckt.name, bckt.consistencyLevel()); err != nil {
+		return fmt.Errorf("Setting consistency failed: %s", err)
+	}
+
+	if bckt.replication != "" {
+		return b.enableReplication(bckt)
+	}
+
+	if current.replication != "" {
+		return b.disableReplication(bckt.name)
+	}
+
+	return nil
+}
+
+// Reads the configuration of an existing bucket. Settings that are not configured are left empty, any other error is returned.
+func (b *broker) getBucketConfig(bucketName string) (Bucket, error) {
+	bckt := Bucket{name: bucketName}
+	var err error
+
+	if bckt.lifecycle, err = b.s3client.GetBucketLifecycle(bucketName); err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine lifecycle rules for bucket %s. %s", bucketName, err)
+	}
+
+	if bckt.cors, err = b.s3client.GetBucketCors(bucketName); err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine CORS rules for bucket %s. %s", bucketName, err)
+	}
+
+	if bckt.encryption, err = b.s3client.GetBucketEncryption(bucketName); err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine default encryption for bucket %s. %s", bucketName, err)
+	}
+
+	if bckt.consistency, err = b.sgClient.GetBucketConsistency(bucketName); err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine consistency for bucket %s. %s", bucketName, err)
+	}
+	if bckt.consistency == defaultConsistency {
+		bckt.consistency = ""
+	}
+
+	if bckt.replication, err = b.getBucketReplication(bucketName); err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine replication for bucket %s. %s", bucketName, err)
+	}
+
+	return bckt, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// S3 allows 50 tags per bucket, some of them are taken by the broker
+const maxBucketTags = 50
+
+// Tags the broker sets on every bucket. They can't be set with parameters.
+var managedTagKeys = []string{"instance-id", "platform", "org-guid", "org-name", "space-guid", "space-name", "instance-name"}
+
+// Returns the tags of a bucket without the ones the broker maintains, nil when there are none
+func requestedTags(tags map[string]string) map[string]string {
+	requested := make(map[string]string)
+	for key, value := range tags {
+		if !contains(managedTagKeys, key) {
+			requested[key] = value
+		}
+	}
+
+	if len(requested) == 0 {
+		return nil
+	}
+
+	return requested
+}
+
+// Returns the tags of a bucket: the instance-wide default tags overridden by the tags of the bucket
+func mergeTags(defaults, bucketTags map[string]string) map[string]string {
+	if len(defaults) == 0 && len(bucketTags) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	for key, value := range defaults {
+		tags[key] = value
+	}
+	for key, value := range bucketTags {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// Checks requested tags against the S3 limits and the tags managed by the broker
+func validateTags(bucketName string, tags map[string]string) error {
+	if len(tags)+len(managedTagKeys) > maxBucketTags {
+		return errInvalidTags(fmt.Errorf("Bucket %s has %d tags, at most %d are allowed", bucketName, len(tags), maxBucketTags-len(managedTagKeys)))
+	}
+
+	for key, value := range tags {
+		if len(key) == 0 || len([]rune(key)) > 128 || invalidTagChars.MatchString(key) {
+			return errInvalidTags(fmt.Errorf("Invalid tag key \"%s\" for bucket %s. Keys have 1 to 128 letters, digits, spaces or + - = . _ : / @", key, bucketName))
+		}
+
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return errInvalidTags(fmt.Errorf("Tag key \"%s\" for bucket %s uses the reserved prefix aws:", key, bucketName))
+		}
+
+		for _, managed := range managedTagKeys {
+			if key == managed {
+				return errInvalidTags(fmt.Errorf("Tag key \"%s\" for bucket %s is set by the broker", key, bucketName))
+			}
+		}
+
+		if len([]rune(value)) > 256 || invalidTagChars.MatchString(value) {
+			return errInvalidTags(fmt.Errorf("Invalid value for tag \"%s\" of bucket %s. Values have up to 256 letters, digits, spaces or + - = . _ : / @", key, bucketName))
+		}
+	}
+
+	return nil
+}
+
+func errInvalidTags(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-tags")
+}
+
+// Returns the tags a bucket should have: its requested tags together with the tags managed by the broker
+func bucketTagSet(rec instanceRecord, bckt Bucket) map[string]string {
+	return mergeTags(bckt.tags, parsePlatformContext(rec.Context).bucketTags(rec.InstanceID))
+}
+
+// Sets the tags of the buckets of an instance. Tags that are no longer requested are removed. Returns the buckets that couldn't be tagged.
+func (b *broker) tagBuckets(rec instanceRecord, buckets map[string]Bucket) []error {
+	var errs []error
+	for friendlyName, bckt := range buckets {
+		if err := b.s3client.PutBucketTagging(bckt.name, bucketTagSet(rec, bckt)); err != nil {
+			log.Printf("Tagging bucket %s failed: %s", bckt.name, err)
+			errs = append(errs, fmt.Errorf("Tagging bucket %s failed: %s", friendlyName, err))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults map[string]string
+		bucket   map[string]string
+		want     map[string]string
+	}{
+		{"none", nil, nil, nil},
+		{"defaults only", map[string]string{"team": "a"}, nil, map[string]string{"team": "a"}},
+		{"bucket overrides default", map[string]string{"team": "a", "env": "dev"}, map[string]string{"team": "b"}, map[string]string{"team": "b", "env": "dev"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeTags(tt.defaults, tt.bucket); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i < maxBucketTags-len(managedTagKeys)+1; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		wantErr bool
+	}{
+		{"valid", map[string]string{"cost-center": "4711", "owner": "team a@example.com"}, false},
+		{"too many", tooMany, true},
+		{"empty key", map[string]string{"": "value"}, true},
+		{"reserved prefix", map[string]string{"aws:owner": "value"}, true},
+		{"managed key", map[string]string{"instance-id": "value"}, true},
+		{"invalid character", map[string]string{"owner": "a&b"}, true},
+		{"value too long", map[string]string{"owner": strings.Repeat("a", 257)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateTags("bucket", tt.tags); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBucketTagSet(t *testing.T) {
+	rec := instanceRecord{
+		InstanceID: "instance",
+		Context:    json.RawMessage(`{"platform": "cloudfoundry", "space_name": "dev"}`),
+	}
+	bckt := Bucket{tags: map[string]string{"cost-center": "4711"}}
+
+	want := map[string]string{"cost-center": "4711", "instance-id": "instance", "platform": "cloudfoundry", "space-name": "dev"}
+	if got := bucketTagSet(rec, bckt); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	//tags survive the state store
+	if got := recordsToBuckets(bucketsToRecords(map[string]Bucket{"a": bckt}))["a"].tags; !reflect.DeepEqual(got, bckt.tags) {
+		t.Errorf("recorded tags: got %v, want %v", got, bckt.tags)
+	}
+}
+
+func TestRequestedTags(t *testing.T) {
+	tags := map[string]string{"cost-center": "4711", "instance-id": "instance", "space-name": "dev"}
+
+	if got, want := requestedTags(tags), map[string]string{"cost-center": "4711"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := requestedTags(map[string]string{"platform": "cloudfoundry"}); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net/http"
 
 	"github.com/pivotal-cf/brokerapi"
 )
@@ -23,3 +24,52 @@ func CatalogLoad(catalogFilePath string) ([]brokerapi.Service, error) {
 	services[0].Metadata.DocumentationUrl = ""
 	return services, nil
 }
+
+// Returns the IDs of the services that set allow_context_updates in the catalog. brokerapi doesn't know the field, see catalogMiddleware.
+func CatalogContextUpdates(catalogFilePath string) (map[string]bool, error) {
+	var services []struct {
+		ID                  string `json:"id"`
+		AllowContextUpdates bool   `json:"allow_context_updates"`
+	}
+
+	inBuf, err := ioutil.ReadFile(catalogFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(inBuf, &services); err != nil {
+		return nil, err
+	}
+
+	contextUpdates := make(map[string]bool)
+	for _, service := range services {
+		if service.AllowContextUpdates {
+			contextUpdates[service.ID] = true
+		}
+	}
+
+	return contextUpdates, nil
+}
+
+// Adds allow_context_updates to the services in the catalog response so the platform sends updates when an instance, space or org is renamed
+func catalogMiddleware(next http.Handler, contextUpdates map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/v2/catalog" || len(contextUpdates) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rewriteResponse(w, r, next, func(body map[string]interface{}) {
+			services, _ := body["services"].([]interface{})
+			for _, s := range services {
+				service, ok := s.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if id, _ := service["id"].(string); contextUpdates[id] {
+					service["allow_context_updates"] = true
+				}
+			}
+		})
+	})
+}
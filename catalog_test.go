@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalogContextUpdates(t *testing.T) {
+	contextUpdates, err := CatalogContextUpdates("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := CatalogLoad("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contextUpdates[services[0].ID] {
+		t.Errorf("service %s doesn't allow context updates", services[0].Name)
+	}
+}
+
+func TestCatalogMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"services": [{"id": "a", "name": "allowed"}, {"id": "b", "name": "other"}]}`))
+	})
+	handler := catalogMiddleware(next, map[string]bool{"a": true})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/catalog", nil))
+
+	var catalog struct {
+		Services []struct {
+			ID                  string `json:"id"`
+			AllowContextUpdates bool   `json:"allow_context_updates"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, service := range catalog.Services {
+		if want := service.ID == "a"; service.AllowContextUpdates != want {
+			t.Errorf("service %s: got allow_context_updates %v, want %v", service.ID, service.AllowContextUpdates, want)
+		}
+	}
+}
@@ -1,21 +1,40 @@
 package main
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type brokerConfig struct {
-	BrokerUsername            string `envconfig:"broker_username" required:"true"`
-	BrokerPassword            string `envconfig:"broker_password" required:"true"`
-	StorageGridTenantUsername string `envconfig:"storagegrid_tenant_username" required:"true"`
-	StorageGridTenantPassword string `envconfig:"storagegrid_tenant_password" required:"true"`
-	StorageGridAdminURL       string `envconfig:"storagegrid_admin_url" required:"true"`
-	StorageGridSkipSSLCheck   bool   `envconfig:"storagegrid_skip_ssl_check" default:"false"`
-	StorageGridAccountID      string `envconfig:"storagegrid_account_id" required:"true"`
-	S3Endpoint                string `envconfig:"s3_endpoint" required:"true"`
-	S3Region                  string `envconfig:"s3_region" default:"us-east-1"`
-	S3ForcePathStyle          bool   `envconfig:"s3_path_style" default:"true"`
-	LogLevel                  string `envconfig:"log_level" default:"INFO"`
-	Port                      string `envconfig:"port" default:"3000"`
-	DocsURL                   string `envconfig:"docsurl" default:"default"`
+	BrokerUsername            string               `envconfig:"broker_username" required:"true"`
+	BrokerPassword            string               `envconfig:"broker_password" required:"true"`
+	StorageGridTenantUsername string               `envconfig:"storagegrid_tenant_username" required:"true"`
+	StorageGridTenantPassword string               `envconfig:"storagegrid_tenant_password" required:"true"`
+	StorageGridAdminURL       string               `envconfig:"storagegrid_admin_url" required:"true"`
+	StorageGridSkipSSLCheck   bool                 `envconfig:"storagegrid_skip_ssl_check" default:"false"`
+	StorageGridAccountID      string               `envconfig:"storagegrid_account_id" required:"true"`
+	S3Endpoint                string               `envconfig:"s3_endpoint" required:"true"`
+	S3Region                  string               `envconfig:"s3_region" default:"us-east-1"`
+	S3ForcePathStyle          bool                 `envconfig:"s3_path_style" default:"true"`
+	LogLevel                  string               `envconfig:"log_level" default:"INFO"`
+	Port                      string               `envconfig:"port" default:"3000"`
+	DocsURL                   string               `envconfig:"docsurl" default:"default"`
+	BindingStore              string               `envconfig:"binding_store" default:""`
+	BindingStorePath          string               `envconfig:"binding_store_path" default:""`
+	BindingStoreBucket        string               `envconfig:"binding_store_bucket" default:""`
+	BindingStoreKey           string               `envconfig:"binding_store_key" default:""`
+	StateStore                string               `envconfig:"state_store" default:""`
+	StateStorePath            string               `envconfig:"state_store_path" default:"state.db"`
+	StateStoreBucket          string               `envconfig:"state_store_bucket" default:""`
+	BindingLifetime           time.Duration        `envconfig:"binding_lifetime" default:"0"`
+	ServiceKeyLifetime        time.Duration        `envconfig:"service_key_lifetime" default:"0"`
+	MeteringInterval          time.Duration        `envconfig:"metering_interval" default:"1h"`
+	MeteringRetention         time.Duration        `envconfig:"metering_retention" default:"8760h"`
+	QuotaCheckInterval        time.Duration        `envconfig:"quota_check_interval" default:"5m"`
+	OperationRetention        time.Duration        `envconfig:"operation_retention" default:"168h"`
+	BindingRenewBefore        time.Duration        `envconfig:"binding_renew_before" default:"24h"`
+	ReplicationEndpoints      replicationEndpoints `envconfig:"replication_endpoints" default:""`
 }
 
 func brokerConfigLoad() (brokerConfig, error) {
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// The consistency level of new buckets in StorageGRID
+const defaultConsistency = "read-after-new-write"
+
+var consistencyLevels = []string{"all", "strong-global", "strong-site", defaultConsistency, "available"}
+
+func validateConsistencyParam(bucketName, consistency string) error {
+	if consistency == "" || contains(consistencyLevels, consistency) {
+		return nil
+	}
+
+	err := fmt.Errorf("Invalid consistency \"%s\" for bucket %s. Use %s", consistency, bucketName, strings.Join(consistencyLevels, ", "))
+	return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-consistency")
+}
+
+// Returns the consistency level of a bucket, buckets without a requested level have the StorageGRID default
+func (bckt Bucket) consistencyLevel() string {
+	if bckt.consistency == "" {
+		return defaultConsistency
+	}
+
+	return bckt.consistency
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// ProvisionParamsCORSRule allows browsers on the given origins to access a bucket
+type ProvisionParamsCORSRule struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty"`
+	MaxAgeSeconds  int64    `json:"max_age_seconds,omitempty"`
+}
+
+var corsMethods = []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodHead}
+
+// Validates the CORS rules of a bucket
+func parseCORSParam(bucketName string, rules []ProvisionParamsCORSRule) ([]ProvisionParamsCORSRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	if len(rules) > 100 {
+		return nil, errInvalidCORS(fmt.Errorf("Bucket %s has %d CORS rules, at most 100 are allowed", bucketName, len(rules)))
+	}
+
+	parsed := make([]ProvisionParamsCORSRule, 0, len(rules))
+	for i, rule := range rules {
+		if len(rule.AllowedOrigins) == 0 {
+			return nil, errInvalidCORS(fmt.Errorf("CORS rule %d of bucket %s has no allowed_origins", i+1, bucketName))
+		}
+		if len(rule.AllowedMethods) == 0 {
+			return nil, errInvalidCORS(fmt.Errorf("CORS rule %d of bucket %s has no allowed_methods", i+1, bucketName))
+		}
+
+		methods := make([]string, 0, len(rule.AllowedMethods))
+		for _, method := range rule.AllowedMethods {
+			method = strings.ToUpper(method)
+			if !contains(corsMethods, method) {
+				return nil, errInvalidCORS(fmt.Errorf("CORS rule %d of bucket %s allows the invalid method %s. Use %s", i+1, bucketName, method, strings.Join(corsMethods, ", ")))
+			}
+			methods = append(methods, method)
+		}
+		rule.AllowedMethods = methods
+
+		if rule.MaxAgeSeconds < 0 {
+			return nil, errInvalidCORS(fmt.Errorf("CORS rule %d of bucket %s has a negative max_age_seconds", i+1, bucketName))
+		}
+
+		if len(rule.AllowedHeaders) == 0 {
+			rule.AllowedHeaders = nil
+		}
+		if len(rule.ExposeHeaders) == 0 {
+			rule.ExposeHeaders = nil
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+func errInvalidCORS(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-cors")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func corsToS3(rules []ProvisionParamsCORSRule) []*s3.CORSRule {
+	s3Rules := []*s3.CORSRule{}
+	for _, rule := range rules {
+		s3Rule := &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice(rule.AllowedOrigins),
+			AllowedMethods: aws.StringSlice(rule.AllowedMethods),
+		}
+
+		if len(rule.AllowedHeaders) > 0 {
+			s3Rule.AllowedHeaders = aws.StringSlice(rule.AllowedHeaders)
+		}
+		if len(rule.ExposeHeaders) > 0 {
+			s3Rule.ExposeHeaders = aws.StringSlice(rule.ExposeHeaders)
+		}
+		if rule.MaxAgeSeconds > 0 {
+			s3Rule.MaxAgeSeconds = aws.Int64(rule.MaxAgeSeconds)
+		}
+
+		s3Rules = append(s3Rules, s3Rule)
+	}
+
+	return s3Rules
+}
+
+// Converts the CORS configuration of a bucket back to parameters so it can be compared with the requested rules
+func corsFromS3(s3Rules []*s3.CORSRule) []ProvisionParamsCORSRule {
+	var rules []ProvisionParamsCORSRule
+	for _, s3Rule := range s3Rules {
+		rules = append(rules, ProvisionParamsCORSRule{
+			AllowedOrigins: stringsOrNil(s3Rule.AllowedOrigins),
+			AllowedMethods: stringsOrNil(s3Rule.AllowedMethods),
+			AllowedHeaders: stringsOrNil(s3Rule.AllowedHeaders),
+			ExposeHeaders:  stringsOrNil(s3Rule.ExposeHeaders),
+			MaxAgeSeconds:  aws.Int64Value(s3Rule.MaxAgeSeconds),
+		})
+	}
+
+	return rules
+}
+
+func stringsOrNil(values []*string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	return aws.StringValueSlice(values)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCORSParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []ProvisionParamsCORSRule
+		want    []ProvisionParamsCORSRule
+		wantErr bool
+	}{
+		{"no rules", nil, nil, false},
+		{
+			name:  "methods are upper cased",
+			rules: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{"get", "Put"}, MaxAgeSeconds: 300}},
+			want:  []ProvisionParamsCORSRule{{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{"GET", "PUT"}, MaxAgeSeconds: 300}},
+		},
+		{
+			name:  "empty headers are dropped",
+			rules: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, AllowedHeaders: []string{}, ExposeHeaders: []string{}}},
+			want:  []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}},
+		},
+		{name: "no origins", rules: []ProvisionParamsCORSRule{{AllowedMethods: []string{"GET"}}}, wantErr: true},
+		{name: "no methods", rules: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}}}, wantErr: true},
+		{name: "invalid method", rules: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"PATCH"}}}, wantErr: true},
+		{name: "negative max age", rules: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, MaxAgeSeconds: -1}}, wantErr: true},
+		{name: "too many rules", rules: make([]ProvisionParamsCORSRule, 101), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCORSParam("bucket", tt.rules)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The rules read back from S3 have to equal the parsed ones, otherwise Update and reconcile would keep reapplying them
+func TestCORSRoundTrip(t *testing.T) {
+	rules, err := parseCORSParam("bucket", []ProvisionParamsCORSRule{
+		{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET", "HEAD"}},
+		{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{"PUT"}, AllowedHeaders: []string{"*"}, ExposeHeaders: []string{"ETag"}, MaxAgeSeconds: 3000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := corsFromS3(corsToS3(rules)); !reflect.DeepEqual(got, rules) {
+		t.Errorf("got %+v, want %+v", got, rules)
+	}
+}
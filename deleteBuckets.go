@@ -3,12 +3,28 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
 )
 
+// bucketNotEmptyError is returned when S3 refuses to delete a bucket because it still contains objects
+type bucketNotEmptyError struct {
+	name string
+}
+
+// bucketsNotEmptyError combines bucket errors of which at least one is a bucketNotEmptyError
+type bucketsNotEmptyError struct {
+	error
+}
+
+func (e bucketNotEmptyError) Error() string {
+	return fmt.Sprintf("Bucket %s is not empty. Only empty buckets can be deleted", e.name)
+}
+
 type bucketDeleteStatus struct {
 	friendlyName string
 	name         string
@@ -17,7 +33,7 @@ type bucketDeleteStatus struct {
 	err          error
 }
 
-func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []error) {
+func (b *broker) deleteBuckets(op *operation, buckets map[string]Bucket) (map[string]Bucket, []error) {
 	var (
 		delWG sync.WaitGroup
 	)
@@ -34,6 +50,7 @@ func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []
 
 	//Delete buckets concurrently. Sequentially is too slow for more than about 6 buckets.
 	for friendlyName, bucket := range buckets {
+		op.SetBucketStatus(friendlyName, "deleting")
 
 		go func(friendlyName string, bucket Bucket) {
 			defer delWG.Done()
@@ -50,6 +67,14 @@ func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []
 			if _, err := b.s3client.DeleteBucket(bucket.name); err != nil {
 				if awsErr, ok := err.(awserr.Error); ok {
 					if awsErr.Code() == s3.ErrCodeNoSuchBucket {
+						b.removeReplicationEndpoints(op, bucket.name)
+						statusChan <- status
+						return
+					}
+
+					if awsErr.Code() == "BucketNotEmpty" {
+						status.deleted = false
+						status.err = bucketNotEmptyError{name: bucket.name}
 						statusChan <- status
 						return
 					}
@@ -61,6 +86,7 @@ func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []
 				return
 			}
 
+			b.removeReplicationEndpoints(op, bucket.name)
 			statusChan <- status
 			return
 		}(friendlyName, bucket)
@@ -69,10 +95,17 @@ func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []
 	var errors []error
 	for status := range statusChan {
 		if status.err != nil {
-			errors = append(errors, fmt.Errorf("Error deleting bucket %s: %s", status.name, status.err.Error()))
+			if _, ok := status.err.(bucketNotEmptyError); ok {
+				op.SetBucketStatus(status.friendlyName, "not empty")
+				errors = append(errors, status.err)
+			} else {
+				op.SetBucketStatus(status.friendlyName, fmt.Sprintf("deletion failed (%s)", status.err))
+				errors = append(errors, fmt.Errorf("Error deleting bucket %s: %s", status.name, status.err.Error()))
+			}
 		}
 
 		if status.deleted {
+			op.SetBucketStatus(status.friendlyName, "deleted")
 			deletedBuckets[status.friendlyName] = Bucket{
 				name:   status.name,
 				region: status.region,
@@ -86,3 +119,34 @@ func (b *broker) deleteBuckets(buckets map[string]Bucket) (map[string]Bucket, []
 
 	return deletedBuckets, nil
 }
+
+// Combines the errors of several bucket actions into a single error. If any bucket was not empty a bucketsNotEmptyError is returned.
+func combineBucketErrors(msg string, errs []error) error {
+	var (
+		errorString string
+		notEmpty    bool
+	)
+
+	for _, e := range errs {
+		errorString = fmt.Sprintf("%s -- %s", errorString, e)
+		if _, ok := e.(bucketNotEmptyError); ok {
+			notEmpty = true
+		}
+	}
+
+	err := fmt.Errorf("%s: %s", msg, errorString)
+	if notEmpty {
+		return bucketsNotEmptyError{err}
+	}
+
+	return err
+}
+
+// Turns errors caused by non-empty buckets into a failure response so the platform shows the description instead of a generic server error
+func bucketFailureResponse(err error) error {
+	if _, ok := err.(bucketsNotEmptyError); ok {
+		return apiresponses.NewFailureResponse(err, http.StatusUnprocessableEntity, "bucket-not-empty")
+	}
+
+	return err
+}
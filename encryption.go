@@ -0,0 +1,40 @@
+package main
+
+// Plans with "require_encryption" in the plan metadata encrypt all buckets and deny uploads that don't ask for server-side encryption
+const planEncryptionKey = "require_encryption"
+
+// Server-side encryption with keys managed by StorageGRID, as reported in the credentials
+const sseS3 = "sse-s3"
+
+func (b *broker) planRequiresEncryption(planID string) bool {
+	for _, service := range b.services {
+		for _, plan := range service.Plans {
+			if plan.ID != planID || plan.Metadata == nil {
+				continue
+			}
+
+			required, _ := plan.Metadata.AdditionalMetadata[planEncryptionKey].(bool)
+			return required
+		}
+	}
+
+	return false
+}
+
+// Applies the encryption requirement of a plan to the requested buckets
+func (b *broker) applyPlanEncryption(planID string, buckets map[string]Bucket) {
+	required := b.planRequiresEncryption(planID)
+	for friendlyName, bckt := range buckets {
+		bckt.encryptionRequired = required
+		bckt.encryption = bckt.encryption || required
+		buckets[friendlyName] = bckt
+	}
+}
+
+func (bckt Bucket) encryptionName() string {
+	if !bckt.encryption {
+		return ""
+	}
+
+	return sseS3
+}
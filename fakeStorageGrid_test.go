@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorageGrid is an in-memory StorageGRID tenant API with the groups, users and keys the broker manages
+type fakeStorageGrid struct {
+	groups  map[string]sgGroup    //by group name
+	users   map[string]sgUser     //by user name
+	keys    map[string][]sgS3Cred //by user ID
+	deleted []string              //the deleted groups, users and keys
+	failing map[string]bool       //requests ("<method> <path>") answered with an internal server error
+	nextID  int
+	mutex   sync.Mutex
+}
+
+// Starts a fake StorageGRID and returns a client for it
+func newFakeStorageGrid(t *testing.T) (*fakeStorageGrid, *storageGridClient) {
+	fake := &fakeStorageGrid{
+		groups:  make(map[string]sgGroup),
+		users:   make(map[string]sgUser),
+		keys:    make(map[string][]sgS3Cred),
+		failing: make(map[string]bool),
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := NewStorageGridClient(server.URL, false, "account", "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, client
+}
+
+func (f *fakeStorageGrid) id(kind string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", kind, f.nextID)
+}
+
+func (f *fakeStorageGrid) AddGroup(name string, policy string) sgGroup {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	grp := sgGroup{ID: f.id("group"), UniqueName: "group/" + name, DisplayName: name, Policies: json.RawMessage(policy)}
+	f.groups[name] = grp
+	return grp
+}
+
+func (f *fakeStorageGrid) AddUser(name string, accessKeys ...string) sgUser {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	user := sgUser{ID: f.id("user"), UniqueName: "user/" + name}
+	f.users[name] = user
+	for _, accessKey := range accessKeys {
+		f.keys[user.ID] = append(f.keys[user.ID], sgS3Cred{ID: f.id("key"), AccessKey: accessKey})
+	}
+	return user
+}
+
+// Makes requests with the method to the path (below /api/v3/) fail
+func (f *fakeStorageGrid) Fail(method, path string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failing[method+" "+path] = true
+}
+
+func (f *fakeStorageGrid) Group(name string) (sgGroup, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	grp, ok := f.groups[name]
+	return grp, ok
+}
+
+func (f *fakeStorageGrid) User(name string) (sgUser, []sgS3Cred, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	user, ok := f.users[name]
+	return user, f.keys[user.ID], ok
+}
+
+func (f *fakeStorageGrid) Deleted() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.deleted...)
+}
+
+func (f *fakeStorageGrid) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path := strings.TrimPrefix(strings.ReplaceAll(r.URL.Path, "//", "/"), "/api/v3/")
+	parts := strings.Split(path, "/")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	respond := func(status int, data interface{}) {
+		w.WriteHeader(status)
+		raw, _ := json.Marshal(data)
+		json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: raw})
+	}
+
+	if f.failing[r.Method+" "+path] {
+		respond(http.StatusInternalServerError, nil)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && path == "authorize":
+		w.Header().Set("Expires", time.Now().Add(time.Hour).UTC().Format("Mon, 2 Jan 2006 15:04:05 GMT"))
+		respond(http.StatusOK, "token")
+
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[1] == "groups" && parts[2] == "group":
+		grp, ok := f.groups[parts[3]]
+		if !ok {
+			respond(http.StatusNotFound, nil)
+			return
+		}
+		respond(http.StatusOK, grp)
+
+	case r.Method == http.MethodPost && path == "org/groups":
+		var grp sgGroup
+		json.Unmarshal(body, &grp)
+		name := strings.TrimPrefix(grp.UniqueName, "group/")
+		if _, ok := f.groups[name]; ok {
+			respond(http.StatusConflict, nil)
+			return
+		}
+		grp.ID = f.id("group")
+		f.groups[name] = grp
+		respond(http.StatusCreated, grp)
+
+	case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && len(parts) == 3 && parts[1] == "groups":
+		for name, grp := range f.groups {
+			if grp.ID != parts[2] {
+				continue
+			}
+			if r.Method == http.MethodDelete {
+				delete(f.groups, name)
+				f.deleted = append(f.deleted, "group "+name)
+				respond(http.StatusNoContent, nil)
+				return
+			}
+			json.Unmarshal(body, &grp)
+			f.groups[name] = grp
+			respond(http.StatusOK, grp)
+			return
+		}
+		respond(http.StatusNotFound, nil)
+
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[1] == "users" && parts[2] == "user":
+		user, ok := f.users[parts[3]]
+		if !ok {
+			respond(http.StatusNotFound, nil)
+			return
+		}
+		respond(http.StatusOK, user)
+
+	case r.Method == http.MethodPost && path == "org/users":
+		var user sgUser
+		json.Unmarshal(body, &user)
+		name := strings.TrimPrefix(user.UniqueName, "user/")
+		if _, ok := f.users[name]; ok {
+			respond(http.StatusConflict, nil)
+			return
+		}
+		user.ID = f.id("user")
+		f.users[name] = user
+		respond(http.StatusCreated, user)
+
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "users":
+		for name, user := range f.users {
+			if user.ID == parts[2] {
+				delete(f.users, name)
+				delete(f.keys, user.ID)
+				f.deleted = append(f.deleted, "user "+name)
+				respond(http.StatusNoContent, nil)
+				return
+			}
+		}
+		respond(http.StatusNotFound, nil)
+
+	case len(parts) >= 4 && parts[1] == "users" && parts[3] == "s3-access-keys":
+		userID := parts[2]
+		switch {
+		case r.Method == http.MethodGet:
+			respond(http.StatusOK, append([]sgS3Cred{}, f.keys[userID]...))
+		case r.Method == http.MethodPost:
+			var request sgS3Cred
+			json.Unmarshal(body, &request)
+			id := f.id("key")
+			key := sgS3Cred{ID: id, AccessKey: "AK-" + id, SecretAccessKey: "SK-" + id, Expires: request.Expires}
+			f.keys[userID] = append(f.keys[userID], key)
+			respond(http.StatusCreated, key)
+		case r.Method == http.MethodDelete && len(parts) == 5:
+			keys := f.keys[userID]
+			for i, key := range keys {
+				if key.ID == parts[4] {
+					f.keys[userID] = append(keys[:i:i], keys[i+1:]...)
+					f.deleted = append(f.deleted, "key "+key.ID)
+					respond(http.StatusNoContent, nil)
+					return
+				}
+			}
+			respond(http.StatusNotFound, nil)
+		default:
+			respond(http.StatusMethodNotAllowed, nil)
+		}
+
+	default:
+		respond(http.StatusNotFound, nil)
+	}
+}
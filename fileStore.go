@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errKeyNotFound = errors.New("Key not found")
+
+// fileStore is a small embedded key/value database which keeps all values in memory and persists them to a single json file on every change
+type fileStore struct {
+	path  string
+	data  map[string][]byte
+	mutex sync.Mutex
+}
+
+// Opens (or creates) the file database at path
+func NewFileStore(path string) (*fileStore, error) {
+	store := fileStore{
+		path:  path,
+		data:  make(map[string][]byte),
+		mutex: sync.Mutex{},
+	}
+
+	inBuf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &store, nil
+		}
+		return nil, fmt.Errorf("Error reading file store %s: %s", path, err)
+	}
+
+	if len(inBuf) == 0 {
+		return &store, nil
+	}
+
+	err = json.Unmarshal(inBuf, &store.data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing file store %s: %s", path, err)
+	}
+
+	return &store, nil
+}
+
+func (f *fileStore) Get(key string) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	value, ok := f.data[key]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+
+	return value, nil
+}
+
+func (f *fileStore) Put(key string, value []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.data[key] = value
+	return f.persist()
+}
+
+func (f *fileStore) Delete(key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, ok := f.data[key]; !ok {
+		return nil
+	}
+
+	delete(f.data, key)
+	return f.persist()
+}
+
+// Returns all keys starting with prefix in sorted order
+func (f *fileStore) Keys(prefix string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	keys := []string{}
+	for key := range f.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Writes the database to a temporary file first and then renames it so a crash never leaves a half written file behind. Caller must hold the mutex.
+func (f *fileStore) persist() error {
+	outBuf, err := json.Marshal(f.data)
+	if err != nil {
+		return fmt.Errorf("Error marshalling file store: %s", err)
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file for file store: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(outBuf); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("Error writing file store: %s", err)
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("Error writing file store: %s", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("Error writing file store: %s", err)
+	}
+
+	return os.Rename(tmpFile.Name(), f.path)
+}
@@ -4,22 +4,89 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"text/template"
 )
 
+var policyTemplates = map[string]string{
+	accessReadWrite:         "group_policy.json.tmpl",
+	accessReadOnly:          "group_policy_read-only.json.tmpl",
+	accessWriteOnly:         "group_policy_write-only.json.tmpl",
+	accessReadWriteNoDelete: "group_policy_read-write-no-delete.json.tmpl",
+}
+
 func GenerateS3Policy(instanceID string, buckets map[string]Bucket) (string, error) {
-	t := template.Must(template.ParseFiles("group_policy.json.tmpl"))
+	return GenerateS3AccessPolicy(instanceID, accessReadWrite, buckets)
+}
+
+// Generates the policy for the group of bindings with the given access level
+func GenerateS3AccessPolicy(instanceID, access string, buckets map[string]Bucket) (string, error) {
+	tmplFile, ok := policyTemplates[access]
+	if !ok {
+		return "", fmt.Errorf("Unknown access level: %s", access)
+	}
+
+	t := template.Must(template.ParseFiles(tmplFile, "group_policy_prefixes.json.tmpl", "group_policy_quota.json.tmpl", "group_policy_encryption.json.tmpl"))
+
+	type prefixedBucket struct {
+		Name     string
+		Prefixes string
+	}
 
 	var (
-		BucketRsrcs  []string = []string{}
-		ObjectsRsrcs []string = []string{}
+		BucketRsrcs     []string         = []string{}
+		UnprefixedRsrcs []string         = []string{}
+		ObjectsRsrcs    []string         = []string{}
+		PrefixedBuckets []prefixedBucket = []prefixedBucket{}
+		QuotaRsrcs      []string         = []string{}
+		EncryptionRsrcs []string         = []string{}
 	)
 
 	for _, bucket := range buckets {
 		BucketRsrcs = append(BucketRsrcs, fmt.Sprintf("urn:sgws:s3:::%s", bucket.name))
-		ObjectsRsrcs = append(ObjectsRsrcs, fmt.Sprintf("urn:sgws:s3:::%s/*", bucket.name))
+
+		//uploads (including multipart uploads and copies) are denied while the instance is over its quota
+		if bucket.quotaExceeded {
+			QuotaRsrcs = append(QuotaRsrcs, fmt.Sprintf("urn:sgws:s3:::%s/*", bucket.name))
+		}
+
+		//plans can require every upload to ask for server-side encryption
+		if bucket.encryptionRequired {
+			EncryptionRsrcs = append(EncryptionRsrcs, fmt.Sprintf("urn:sgws:s3:::%s/*", bucket.name))
+		}
+
+		if len(bucket.prefixes) == 0 {
+			UnprefixedRsrcs = append(UnprefixedRsrcs, fmt.Sprintf("urn:sgws:s3:::%s", bucket.name))
+			ObjectsRsrcs = append(ObjectsRsrcs, fmt.Sprintf("urn:sgws:s3:::%s/*", bucket.name))
+			continue
+		}
+
+		//restrict objects to the prefixes and deny listing anything outside of them
+		var listPrefixes []string
+		for _, prefix := range bucket.prefixes {
+			ObjectsRsrcs = append(ObjectsRsrcs, fmt.Sprintf("urn:sgws:s3:::%s/%s*", bucket.name, prefix))
+			listPrefixes = append(listPrefixes, prefix+"*")
+		}
+
+		lpBytes, err := json.Marshal(listPrefixes)
+		if err != nil {
+			return "", fmt.Errorf("Error generating policy: %s", err)
+		}
+
+		PrefixedBuckets = append(PrefixedBuckets, prefixedBucket{
+			Name:     bucket.name,
+			Prefixes: string(lpBytes),
+		})
 	}
 
+	//sort everything so the same buckets always result in the same policy
+	sort.Strings(BucketRsrcs)
+	sort.Strings(UnprefixedRsrcs)
+	sort.Strings(ObjectsRsrcs)
+	sort.Strings(QuotaRsrcs)
+	sort.Strings(EncryptionRsrcs)
+	sort.Slice(PrefixedBuckets, func(i, j int) bool { return PrefixedBuckets[i].Name < PrefixedBuckets[j].Name })
+
 	if len(BucketRsrcs) == 0 {
 		return "{}", nil
 	}
@@ -34,14 +101,50 @@ func GenerateS3Policy(instanceID string, buckets map[string]Bucket) (string, err
 		return "", fmt.Errorf("Error generating policy: %s", err)
 	}
 
+	//read-write policies scoped to prefixes only allow listing the buckets without prefixes without a condition
+	var unprefixedResources string
+	if len(PrefixedBuckets) > 0 && len(UnprefixedRsrcs) > 0 {
+		urBytes, err := json.Marshal(UnprefixedRsrcs)
+		if err != nil {
+			return "", fmt.Errorf("Error generating policy: %s", err)
+		}
+		unprefixedResources = string(urBytes)
+	}
+
+	var quotaResources string
+	if len(QuotaRsrcs) > 0 {
+		qrBytes, err := json.Marshal(QuotaRsrcs)
+		if err != nil {
+			return "", fmt.Errorf("Error generating policy: %s", err)
+		}
+		quotaResources = string(qrBytes)
+	}
+
+	var encryptionResources string
+	if len(EncryptionRsrcs) > 0 {
+		erBytes, err := json.Marshal(EncryptionRsrcs)
+		if err != nil {
+			return "", fmt.Errorf("Error generating policy: %s", err)
+		}
+		encryptionResources = string(erBytes)
+	}
+
 	data := struct {
-		InstanceID      string
-		BucketResources string
-		ObjectResources string
+		InstanceID                string
+		BucketResources           string
+		UnprefixedBucketResources string
+		ObjectResources           string
+		PrefixedBuckets           []prefixedBucket
+		QuotaResources            string
+		EncryptionResources       string
 	}{
-		InstanceID:      instanceID,
-		BucketResources: string(brBytes),
-		ObjectResources: string(orBytes),
+		InstanceID:                instanceID,
+		BucketResources:           string(brBytes),
+		UnprefixedBucketResources: unprefixedResources,
+		ObjectResources:           string(orBytes),
+		PrefixedBuckets:           PrefixedBuckets,
+		QuotaResources:            quotaResources,
+		EncryptionResources:       encryptionResources,
 	}
 
 	var b bytes.Buffer
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testPolicy struct {
+	S3 struct {
+		Statement []struct {
+			Sid      string
+			Effect   string
+			Resource interface{}
+		}
+	}
+}
+
+func TestGenerateS3AccessPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		access  string
+		buckets map[string]Bucket
+		want    map[string]interface{} //Sid => Resource
+	}{
+		{
+			name:    "read-write",
+			access:  accessReadWrite,
+			buckets: map[string]Bucket{"b": {name: "b-2"}, "a": {name: "a-1"}},
+			want: map[string]interface{}{
+				"DefaultBindAccessBuckets-inst": []interface{}{"urn:sgws:s3:::a-1", "urn:sgws:s3:::b-2"},
+				"DefaultBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/*", "urn:sgws:s3:::b-2/*"},
+			},
+		},
+		{
+			name:    "read-write with prefixes",
+			access:  accessReadWrite,
+			buckets: map[string]Bucket{"a": {name: "a-1", prefixes: []string{"logs/"}}, "b": {name: "b-2"}},
+			want: map[string]interface{}{
+				"ScopedBindAccessBuckets-inst":  []interface{}{"urn:sgws:s3:::a-1", "urn:sgws:s3:::b-2"},
+				"ScopedBindListBuckets-inst":    []interface{}{"urn:sgws:s3:::b-2"},
+				"ScopedBindListPrefixes-a-1":    "urn:sgws:s3:::a-1",
+				"DefaultBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/logs/*", "urn:sgws:s3:::b-2/*"},
+				"PrefixRestriction-a-1":         "urn:sgws:s3:::a-1",
+			},
+		},
+		{
+			name:    "read-write with prefixes only",
+			access:  accessReadWrite,
+			buckets: map[string]Bucket{"a": {name: "a-1", prefixes: []string{"logs/", "tmp/"}}},
+			want: map[string]interface{}{
+				"ScopedBindAccessBuckets-inst":  []interface{}{"urn:sgws:s3:::a-1"},
+				"ScopedBindListPrefixes-a-1":    "urn:sgws:s3:::a-1",
+				"DefaultBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/logs/*", "urn:sgws:s3:::a-1/tmp/*"},
+				"PrefixRestriction-a-1":         "urn:sgws:s3:::a-1",
+			},
+		},
+		{
+			name:    "read-only with prefixes",
+			access:  accessReadOnly,
+			buckets: map[string]Bucket{"a": {name: "a-1", prefixes: []string{"logs/"}}},
+			want: map[string]interface{}{
+				"ReadOnlyBindAccessBuckets-inst": []interface{}{"urn:sgws:s3:::a-1"},
+				"ReadOnlyBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/logs/*"},
+				"PrefixRestriction-a-1":          "urn:sgws:s3:::a-1",
+			},
+		},
+		{
+			name:    "quota exceeded",
+			access:  accessWriteOnly,
+			buckets: map[string]Bucket{"a": {name: "a-1", quotaExceeded: true}},
+			want: map[string]interface{}{
+				"WriteOnlyBindAccessBuckets-inst": []interface{}{"urn:sgws:s3:::a-1"},
+				"WriteOnlyBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/*"},
+				"QuotaExceeded-inst":              []interface{}{"urn:sgws:s3:::a-1/*"},
+			},
+		},
+		{
+			name:    "encryption required",
+			access:  accessReadWriteNoDelete,
+			buckets: map[string]Bucket{"a": {name: "a-1", encryptionRequired: true}, "b": {name: "b-2"}},
+			want: map[string]interface{}{
+				"NoDeleteBindAccessBuckets-inst": []interface{}{"urn:sgws:s3:::a-1", "urn:sgws:s3:::b-2"},
+				"NoDeleteBindAccessObjects-inst": []interface{}{"urn:sgws:s3:::a-1/*", "urn:sgws:s3:::b-2/*"},
+				"RequireEncryption-inst":         []interface{}{"urn:sgws:s3:::a-1/*"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := GenerateS3AccessPolicy("inst", tt.access, tt.buckets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var parsed testPolicy
+			if err := json.Unmarshal([]byte(policy), &parsed); err != nil {
+				t.Fatalf("invalid policy: %s\n%s", err, policy)
+			}
+
+			got := make(map[string]interface{})
+			for _, statement := range parsed.S3.Statement {
+				got[statement.Sid] = statement.Resource
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got statements %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateS3PolicyIsStable(t *testing.T) {
+	buckets := map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-2"}, "c": {name: "c-3", prefixes: []string{"x/"}}}
+
+	first, err := GenerateS3Policy("inst", buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if policy, _ := GenerateS3Policy("inst", buckets); policy != first {
+			t.Fatal("the policy changed between calls")
+		}
+	}
+
+	if policy, _ := GenerateS3Policy("inst", nil); strings.TrimSpace(policy) != "{}" {
+		t.Errorf("policy without buckets: got %s", policy)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -11,16 +12,42 @@ import (
 )
 
 type ProvisionParamsBucket struct {
-	Name       string `json:"name"`
-	Region     string `json:"region"`
-	Versioning bool   `json:"versioning"`
+	Name        string                         `json:"name"`
+	Region      string                         `json:"region"`
+	Versioning  bool                           `json:"versioning"`
+	Tags        map[string]string              `json:"tags"`
+	ObjectLock  *ProvisionParamsObjectLock     `json:"object_lock"`
+	Lifecycle   []ProvisionParamsLifecycleRule `json:"lifecycle"`
+	CORS        []ProvisionParamsCORSRule      `json:"cors"`
+	Encryption  bool                           `json:"encryption"`
+	Consistency string                         `json:"consistency"`
+	Replication string                         `json:"replication"`
 }
 
 type ProvisionParameters struct {
 	Buckets []ProvisionParamsBucket `json:"buckets"`
+	QuotaGB int64                   `json:"quota_gb"`
+	Tags    map[string]string       `json:"tags"` //default tags for all buckets
 }
 
+// Returns the buckets of an instance. When the instance is recorded in the state store the record is used, otherwise the buckets are derived from the group policy.
+// Changes made outside the broker to recorded buckets are found and undone by reconciling (see reconcileInstance).
 func (b *broker) getBucketsFromGroup(group sgGroup) (map[string]Bucket, error) {
+	if b.state != nil {
+		rec, err := b.state.GetInstance(strings.TrimPrefix(group.UniqueName, "group/"))
+		if err == nil {
+			return recordsToBuckets(rec.Buckets), nil
+		}
+		if err != errKeyNotFound {
+			return nil, fmt.Errorf("Unable to retrieve instance for group %s from state store: %s", group.DisplayName, err)
+		}
+	}
+
+	return b.getBucketsFromPolicy(group)
+}
+
+// Derives the buckets of an instance from the group policy and looks up their settings in S3
+func (b *broker) getBucketsFromPolicy(group sgGroup) (map[string]Bucket, error) {
 	var (
 		pol interface{}
 	)
@@ -41,31 +68,62 @@ func (b *broker) getBucketsFromGroup(group sgGroup) (map[string]Bucket, error) {
 		var name string
 		fmt.Sscanf(res.(string), "urn:sgws:s3:::%s", &name)
 
-		region, err := b.s3client.GetBucketRegion(name)
+		bckt, err := b.getLiveBucket(name)
 		if err != nil {
-			if awsErr, ok := err.(awserr.Error); ok {
-				if awsErr.Code() == s3.ErrCodeNoSuchBucket { //do not error out when a bucket is not found. However, keep it on the list. The delete action will ignore the error too and after that the bucket will be deleted from the policy
-					log.Printf("Bucket in policy but not found in S3: %s", name)
-				} else {
-					return nil, fmt.Errorf("Unable to determine region for bucket %s. %s", name, err)
-				}
-			} else {
-				return nil, fmt.Errorf("Unable to determine region for bucket %s. %s", name, err)
-			}
+			return nil, err
 		}
 
-		versioning, _ := b.s3client.GetBucketVersioning(name)
+		//the statement denying unencrypted uploads is only in the policy when the plan requires encryption
+		bckt.encryptionRequired = strings.Contains(string(group.Policies), "RequireEncryption-")
 
-		buckets[getFriendlyNameFromBucketName(name)] = Bucket{
-			name:       name,
-			region:     region,
-			versioning: versioning,
-		}
+		buckets[getFriendlyNameFromBucketName(name)] = bckt
 	}
 
 	return buckets, nil
 }
 
+// Looks up a bucket in S3 and StorageGRID. A bucket that doesn't exist is returned with an empty region and no settings.
+// Settings that are not configured are left empty, any other error is returned so it isn't mistaken for an unconfigured setting.
+func (b *broker) getLiveBucket(name string) (Bucket, error) {
+	region, err := b.s3client.GetBucketRegion(name)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchBucket {
+			//do not error out when a bucket is not found. However, keep it on the list. The delete action will ignore the error too and after that the bucket will be deleted from the policy
+			log.Printf("Bucket in policy but not found in S3: %s", name)
+			return Bucket{name: name}, nil
+		}
+		return Bucket{}, fmt.Errorf("Unable to determine region for bucket %s. %s", name, err)
+	}
+
+	versioning, err := b.s3client.GetBucketVersioning(name)
+	if err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine versioning for bucket %s. %s", name, err)
+	}
+
+	objectLock, err := b.s3client.GetObjectLockConfiguration(name)
+	if err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine Object Lock for bucket %s. %s", name, err)
+	}
+
+	bckt, err := b.getBucketConfig(name)
+	if err != nil {
+		return Bucket{}, err
+	}
+
+	tags, err := b.s3client.GetBucketTagging(name)
+	if err != nil {
+		return Bucket{}, fmt.Errorf("Unable to determine tags for bucket %s. %s", name, err)
+	}
+
+	bckt.region = region
+	bckt.versioning = versioning == s3.BucketVersioningStatusEnabled
+	bckt.suspended = versioning == s3.BucketVersioningStatusSuspended
+	bckt.objectLock = objectLock
+	bckt.tags = requestedTags(tags)
+
+	return bckt, nil
+}
+
 func (b *broker) getRequestedBucketsFromParams(rawParams json.RawMessage) (map[string]Bucket, error) {
 	returnBuckets := make(map[string]Bucket)
 
@@ -76,6 +134,34 @@ func (b *broker) getRequestedBucketsFromParams(rawParams json.RawMessage) (map[s
 	}
 
 	for _, reqBucket := range params.Buckets {
+		tags := mergeTags(params.Tags, reqBucket.Tags)
+		if err := validateTags(reqBucket.Name, tags); err != nil {
+			return nil, err
+		}
+
+		objectLock, err := parseObjectLockParam(reqBucket.Name, reqBucket.ObjectLock)
+		if err != nil {
+			return nil, err
+		}
+
+		lifecycle, err := parseLifecycleParam(reqBucket.Name, reqBucket.Lifecycle)
+		if err != nil {
+			return nil, err
+		}
+
+		cors, err := parseCORSParam(reqBucket.Name, reqBucket.CORS)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := validateConsistencyParam(reqBucket.Name, reqBucket.Consistency); err != nil {
+			return nil, err
+		}
+
+		if err := b.validateReplicationParam(reqBucket.Name, reqBucket.Replication); err != nil {
+			return nil, err
+		}
+
 		var friendlyPart string
 		if len(reqBucket.Name) > 27 {
 			friendlyPart = reqBucket.Name[0:27]
@@ -89,9 +175,16 @@ func (b *broker) getRequestedBucketsFromParams(rawParams json.RawMessage) (map[s
 		}
 
 		bucket := Bucket{
-			name:       friendlyPart,
-			region:     region,
-			versioning: reqBucket.Versioning,
+			name:        friendlyPart,
+			region:      region,
+			versioning:  reqBucket.Versioning || objectLock.enabled() || reqBucket.Replication != "", //Object Lock and replication require versioning
+			tags:        tags,
+			objectLock:  objectLock,
+			lifecycle:   lifecycle,
+			cors:        cors,
+			encryption:  reqBucket.Encryption,
+			consistency: reqBucket.Consistency,
+			replication: reqBucket.Replication,
 		}
 		returnBuckets[bucket.name] = bucket
 	}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// ProvisionParamsLifecycleRule expires objects, noncurrent versions or incomplete multipart uploads. The rule applies to the objects matching
+// the prefix and all tags, or to all objects when neither is set.
+type ProvisionParamsLifecycleRule struct {
+	ID                                 string            `json:"id,omitempty"`
+	Prefix                             string            `json:"prefix,omitempty"`
+	Tags                               map[string]string `json:"tags,omitempty"`
+	ExpirationDays                     int64             `json:"expiration_days,omitempty"`
+	NoncurrentVersionExpirationDays    int64             `json:"noncurrent_version_expiration_days,omitempty"`
+	AbortIncompleteMultipartUploadDays int64             `json:"abort_incomplete_multipart_upload_days,omitempty"`
+}
+
+// Validates the lifecycle rules of a bucket and gives rules without an ID one based on their position
+func parseLifecycleParam(bucketName string, rules []ProvisionParamsLifecycleRule) ([]ProvisionParamsLifecycleRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	if len(rules) > 1000 {
+		return nil, errInvalidLifecycle(fmt.Errorf("Bucket %s has %d lifecycle rules, at most 1000 are allowed", bucketName, len(rules)))
+	}
+
+	ids := make(map[string]bool)
+	parsed := make([]ProvisionParamsLifecycleRule, 0, len(rules))
+	for i, rule := range rules {
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if len(rule.ID) > 255 {
+			return nil, errInvalidLifecycle(fmt.Errorf("The ID of lifecycle rule %d of bucket %s is longer than 255 characters", i+1, bucketName))
+		}
+		if ids[rule.ID] {
+			return nil, errInvalidLifecycle(fmt.Errorf("Bucket %s has more than one lifecycle rule with ID %s", bucketName, rule.ID))
+		}
+		ids[rule.ID] = true
+
+		if rule.ExpirationDays < 0 || rule.NoncurrentVersionExpirationDays < 0 || rule.AbortIncompleteMultipartUploadDays < 0 {
+			return nil, errInvalidLifecycle(fmt.Errorf("Lifecycle rule %s of bucket %s has a negative number of days", rule.ID, bucketName))
+		}
+		if rule.ExpirationDays == 0 && rule.NoncurrentVersionExpirationDays == 0 && rule.AbortIncompleteMultipartUploadDays == 0 {
+			return nil, errInvalidLifecycle(fmt.Errorf("Lifecycle rule %s of bucket %s has no action. Set expiration_days, noncurrent_version_expiration_days or abort_incomplete_multipart_upload_days", rule.ID, bucketName))
+		}
+
+		//S3 doesn't allow aborting uploads in rules that filter on tags
+		if rule.AbortIncompleteMultipartUploadDays > 0 && len(rule.Tags) > 0 {
+			return nil, errInvalidLifecycle(fmt.Errorf("Lifecycle rule %s of bucket %s can't abort incomplete multipart uploads and filter on tags", rule.ID, bucketName))
+		}
+
+		for key, value := range rule.Tags {
+			if len(key) == 0 || invalidTagChars.MatchString(key) || invalidTagChars.MatchString(value) {
+				return nil, errInvalidLifecycle(fmt.Errorf("Lifecycle rule %s of bucket %s filters on an invalid tag \"%s\"", rule.ID, bucketName, key))
+			}
+		}
+		if len(rule.Tags) == 0 {
+			rule.Tags = nil
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+func errInvalidLifecycle(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-lifecycle")
+}
+
+func lifecycleToS3(rules []ProvisionParamsLifecycleRule) []*s3.LifecycleRule {
+	s3Rules := []*s3.LifecycleRule{}
+	for _, rule := range rules {
+		s3Rule := &s3.LifecycleRule{
+			ID:     aws.String(rule.ID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: lifecycleFilter(rule),
+		}
+
+		if rule.ExpirationDays > 0 {
+			s3Rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(rule.ExpirationDays)}
+		}
+		if rule.NoncurrentVersionExpirationDays > 0 {
+			s3Rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(rule.NoncurrentVersionExpirationDays)}
+		}
+		if rule.AbortIncompleteMultipartUploadDays > 0 {
+			s3Rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(rule.AbortIncompleteMultipartUploadDays)}
+		}
+
+		s3Rules = append(s3Rules, s3Rule)
+	}
+
+	return s3Rules
+}
+
+// A filter holds either a prefix or a single tag. Anything more has to be combined with And.
+func lifecycleFilter(rule ProvisionParamsLifecycleRule) *s3.LifecycleRuleFilter {
+	var keys []string
+	for key := range rule.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tags []*s3.Tag
+	for _, key := range keys {
+		tags = append(tags, &s3.Tag{Key: aws.String(key), Value: aws.String(rule.Tags[key])})
+	}
+
+	switch {
+	case len(tags) == 0:
+		return &s3.LifecycleRuleFilter{Prefix: aws.String(rule.Prefix)}
+	case len(tags) == 1 && rule.Prefix == "":
+		return &s3.LifecycleRuleFilter{Tag: tags[0]}
+	default:
+		and := &s3.LifecycleRuleAndOperator{Tags: tags}
+		if rule.Prefix != "" {
+			and.Prefix = aws.String(rule.Prefix)
+		}
+		return &s3.LifecycleRuleFilter{And: and}
+	}
+}
+
+// Converts the lifecycle configuration of a bucket back to parameters so it can be compared with the requested rules
+func lifecycleFromS3(s3Rules []*s3.LifecycleRule) []ProvisionParamsLifecycleRule {
+	var rules []ProvisionParamsLifecycleRule
+	for _, s3Rule := range s3Rules {
+		rule := ProvisionParamsLifecycleRule{
+			ID:     aws.StringValue(s3Rule.ID),
+			Prefix: aws.StringValue(s3Rule.Prefix),
+		}
+
+		tags := make(map[string]string)
+		if filter := s3Rule.Filter; filter != nil {
+			if filter.Prefix != nil {
+				rule.Prefix = *filter.Prefix
+			}
+			if filter.Tag != nil {
+				tags[aws.StringValue(filter.Tag.Key)] = aws.StringValue(filter.Tag.Value)
+			}
+			if filter.And != nil {
+				rule.Prefix = aws.StringValue(filter.And.Prefix)
+				for _, tag := range filter.And.Tags {
+					tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+			}
+		}
+		if len(tags) > 0 {
+			rule.Tags = tags
+		}
+
+		if s3Rule.Expiration != nil {
+			rule.ExpirationDays = aws.Int64Value(s3Rule.Expiration.Days)
+		}
+		if s3Rule.NoncurrentVersionExpiration != nil {
+			rule.NoncurrentVersionExpirationDays = aws.Int64Value(s3Rule.NoncurrentVersionExpiration.NoncurrentDays)
+		}
+		if s3Rule.AbortIncompleteMultipartUpload != nil {
+			rule.AbortIncompleteMultipartUploadDays = aws.Int64Value(s3Rule.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
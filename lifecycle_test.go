@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLifecycleParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []ProvisionParamsLifecycleRule
+		want    []ProvisionParamsLifecycleRule
+		wantErr bool
+	}{
+		{"no rules", nil, nil, false},
+		{
+			name:  "IDs are generated",
+			rules: []ProvisionParamsLifecycleRule{{ExpirationDays: 30}, {ID: "logs", Prefix: "logs/", NoncurrentVersionExpirationDays: 7}},
+			want:  []ProvisionParamsLifecycleRule{{ID: "rule-1", ExpirationDays: 30}, {ID: "logs", Prefix: "logs/", NoncurrentVersionExpirationDays: 7}},
+		},
+		{
+			name:  "empty tags are dropped",
+			rules: []ProvisionParamsLifecycleRule{{ID: "a", Tags: map[string]string{}, ExpirationDays: 1}},
+			want:  []ProvisionParamsLifecycleRule{{ID: "a", ExpirationDays: 1}},
+		},
+		{name: "duplicate IDs", rules: []ProvisionParamsLifecycleRule{{ID: "a", ExpirationDays: 1}, {ID: "a", ExpirationDays: 2}}, wantErr: true},
+		{name: "ID too long", rules: []ProvisionParamsLifecycleRule{{ID: strings.Repeat("a", 256), ExpirationDays: 1}}, wantErr: true},
+		{name: "no action", rules: []ProvisionParamsLifecycleRule{{ID: "a", Prefix: "tmp/"}}, wantErr: true},
+		{name: "negative days", rules: []ProvisionParamsLifecycleRule{{ID: "a", ExpirationDays: -1}}, wantErr: true},
+		{name: "abort uploads with tags", rules: []ProvisionParamsLifecycleRule{{ID: "a", Tags: map[string]string{"k": "v"}, AbortIncompleteMultipartUploadDays: 1}}, wantErr: true},
+		{name: "invalid tag", rules: []ProvisionParamsLifecycleRule{{ID: "a", Tags: map[string]string{"k": "a&b"}, ExpirationDays: 1}}, wantErr: true},
+		{name: "too many rules", rules: make([]ProvisionParamsLifecycleRule, 1001), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLifecycleParam("bucket", tt.rules)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The rules read back from S3 have to equal the parsed ones, otherwise Update and reconcile would keep reapplying them
+func TestLifecycleRoundTrip(t *testing.T) {
+	rules, err := parseLifecycleParam("bucket", []ProvisionParamsLifecycleRule{
+		{ExpirationDays: 30},
+		{Prefix: "logs/", NoncurrentVersionExpirationDays: 7, AbortIncompleteMultipartUploadDays: 1},
+		{Tags: map[string]string{"temp": "true"}, ExpirationDays: 1},
+		{Prefix: "tmp/", Tags: map[string]string{"a": "1", "b": "2"}, ExpirationDays: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := lifecycleFromS3(lifecycleToS3(rules)); !reflect.DeepEqual(got, rules) {
+		t.Errorf("got %+v, want %+v", got, rules)
+	}
+}
+
+func TestBucketConfigChanged(t *testing.T) {
+	lifecycle := []ProvisionParamsLifecycleRule{{ID: "rule-1", ExpirationDays: 30}}
+
+	tests := []struct {
+		name      string
+		current   Bucket
+		requested Bucket
+		want      bool
+	}{
+		{"new bucket without configuration", Bucket{}, Bucket{name: "a", versioning: true}, false},
+		{"new bucket with lifecycle", Bucket{}, Bucket{lifecycle: lifecycle}, true},
+		{"same lifecycle", Bucket{lifecycle: lifecycle}, Bucket{lifecycle: []ProvisionParamsLifecycleRule{{ID: "rule-1", ExpirationDays: 30}}}, false},
+		{"lifecycle removed", Bucket{lifecycle: lifecycle}, Bucket{}, true},
+		{"cors added", Bucket{}, Bucket{cors: []ProvisionParamsCORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}}}, true},
+		{"encryption enabled", Bucket{}, Bucket{encryption: true}, true},
+		{"encryption required", Bucket{encryption: true}, Bucket{encryption: true, encryptionRequired: true}, true},
+		{"default consistency", Bucket{}, Bucket{consistency: defaultConsistency}, false},
+		{"consistency changed", Bucket{}, Bucket{consistency: "strong-global"}, true},
+		{"replication enabled", Bucket{}, Bucket{replication: "dr"}, true},
+		{"tags and versioning are no configuration", Bucket{}, Bucket{tags: map[string]string{"a": "b"}, versioning: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketConfigChanged(tt.current, tt.requested); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -37,6 +37,11 @@ func main() {
 		services[i].Metadata.DocumentationUrl = config.DocsURL
 	}
 
+	contextUpdates, err := CatalogContextUpdates("./catalog.json")
+	if err != nil {
+		panic(err)
+	}
+
 	logger := lager.NewLogger("cf-storagegrid-broker")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, logLevels[config.LogLevel]))
 
@@ -50,11 +55,93 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var state *stateStore
+	switch config.StateStore {
+	case "":
+	case "file":
+		//the file is local to a broker instance, a second instance would keep its own diverging state
+		if !firstBrokerInstance() {
+			log.Fatal("STATE_STORE \"file\" only supports a single broker instance. Use \"s3\" when running more than one")
+		}
+		backend, err := NewFileStore(config.StateStorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		state = NewStateStore(backend)
+	case "s3":
+		backend, err := NewS3Store(s3Client, config.StateStoreBucket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		state = NewStateStore(backend)
+	default:
+		log.Fatalf("Unknown state store: %s. Use \"file\" or \"s3\"", config.StateStore)
+	}
+
+	if state == nil {
+		services = withoutQuotaPlans(services)
+	}
+
+	//setting only BINDING_STORE_PATH keeps the bindings in a file
+	bindingStoreType := config.BindingStore
+	if bindingStoreType == "" && config.BindingStorePath != "" {
+		bindingStoreType = "file"
+	}
+
+	var bindingDB kvBackend
+	switch bindingStoreType {
+	case "":
+	case "file":
+		//like the file state store the file is local to a broker instance
+		if !firstBrokerInstance() {
+			log.Fatal("BINDING_STORE \"file\" only supports a single broker instance. Use \"s3\" when running more than one")
+		}
+		if config.BindingStorePath == "" {
+			log.Fatal("BINDING_STORE_PATH is required for the file binding store")
+		}
+		bindingDB, err = NewFileStore(config.BindingStorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "s3":
+		bindingDB, err = NewS3Store(s3Client, config.BindingStoreBucket)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown binding store: %s. Use \"file\" or \"s3\"", config.BindingStore)
+	}
+
+	var bindings *bindingStore
+	if bindingDB != nil {
+		bindings, err = NewBindingStore(bindingDB, config.BindingStoreKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for i := range services {
+			services[i].BindingsRetrievable = true
+		}
+	}
+
 	serviceBroker := &broker{
-		services: services,
-		env:      config,
-		sgClient: sgClient,
-		s3client: s3Client,
+		services:   services,
+		env:        config,
+		sgClient:   sgClient,
+		s3client:   s3Client,
+		operations: newOperationTracker(state),
+		bindings:   bindings,
+		state:      state,
+	}
+
+	//with a state store operations are journaled and operations of broker instances that died are taken over
+	if state != nil {
+		go serviceBroker.operations.RenewLeases()
+		if firstBrokerInstance() {
+			go serviceBroker.EnforceQuotas()
+			go serviceBroker.RecoverOperations()
+			go serviceBroker.SampleUsage()
+		}
 	}
 
 	admin := adminAPI{
@@ -67,6 +154,10 @@ func main() {
 	brokerHandler := brokerapi.New(serviceBroker, logger, brokerCredentials)
 	fmt.Println("Starting service")
 	http.HandleFunc("/admin/find", admin.FindGroupForBucketHandler)
-	http.Handle("/", brokerHandler)
+	http.HandleFunc("/admin/usage", admin.UsageHandler)
+	http.HandleFunc("/admin/metering", admin.MeteringHandler)
+	http.HandleFunc("/admin/reconcile", admin.ReconcileHandler)
+	http.HandleFunc("/admin/orphans", admin.OrphansHandler)
+	http.Handle("/", catalogMiddleware(instanceMetadataMiddleware(rotationMiddleware(brokerHandler)), contextUpdates))
 	http.ListenAndServe(":"+config.Port, nil)
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usageSample is the usage of a single instance at the time of a sampling round. The CF context is copied into the sample
+// so usage can still be attributed to an org and space after the instance has been deleted.
+type usageSample struct {
+	InstanceID       string `json:"instance_id"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	PlanID           string `json:"plan_id"`
+	ObjectCount      int64  `json:"object_count"`
+	DataBytes        int64  `json:"data_bytes"`
+}
+
+// meteringRound holds the samples of all instances taken at the same time
+type meteringRound struct {
+	Time    time.Time     `json:"time"`
+	Samples []usageSample `json:"samples"`
+}
+
+// meteringRecord is the usage of an instance, space or org over a time range
+type meteringRecord struct {
+	InstanceID       string    `json:"instance_id,omitempty"`
+	OrganizationGUID string    `json:"organization_guid,omitempty"`
+	SpaceGUID        string    `json:"space_guid,omitempty"`
+	From             time.Time `json:"from"`
+	To               time.Time `json:"to"`
+	Samples          int       `json:"samples"`
+	AverageBytes     int64     `json:"average_bytes"`
+	PeakBytes        int64     `json:"peak_bytes"`
+	GBHours          float64   `json:"gb_hours"`
+}
+
+// Returns the org and space from the OSB context of a CF platform
+func cfContextGUIDs(rawContext json.RawMessage) (string, string) {
+	var cfContext struct {
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+	}
+
+	if len(rawContext) == 0 || json.Unmarshal(rawContext, &cfContext) != nil {
+		return "", ""
+	}
+
+	return cfContext.OrganizationGUID, cfContext.SpaceGUID
+}
+
+// Rounds are stored by time so a time range can be selected from the keys alone
+func meteringKey(t time.Time) string {
+	return fmt.Sprintf("metering/%020d", t.UnixNano())
+}
+
+func (s *stateStore) PutMeteringRound(round meteringRound) error {
+	return s.put(meteringKey(round.Time), round)
+}
+
+// Returns the rounds sampled in [from, to) together with the last round before from and the first round after it, which the usage
+// at the start and the end of the range is taken from
+func (s *stateStore) ListMeteringRounds(from, to time.Time) ([]meteringRound, error) {
+	keys, err := s.backend.Keys("metering/")
+	if err != nil {
+		return nil, err
+	}
+
+	//keys are sorted by time
+	var selected []string
+	for _, key := range keys {
+		nanos, err := strconv.ParseInt(strings.TrimPrefix(key, "metering/"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		t := time.Unix(0, nanos)
+		if t.Before(from) {
+			selected = []string{key}
+			continue
+		}
+
+		selected = append(selected, key)
+		if !t.Before(to) {
+			break
+		}
+	}
+
+	rounds := []meteringRound{}
+	for _, key := range selected {
+		var round meteringRound
+		if err := s.get(key, &round); err != nil {
+			return nil, err
+		}
+		rounds = append(rounds, round)
+	}
+
+	return rounds, nil
+}
+
+// Deletes the rounds sampled before the cutoff. The last of those is kept because the usage at the cutoff is taken from it.
+// Returns the number of deleted rounds.
+func (s *stateStore) PruneMeteringRounds(cutoff time.Time) (int, error) {
+	keys, err := s.backend.Keys("metering/")
+	if err != nil {
+		return 0, err
+	}
+
+	//keys are sorted by time
+	var before []string
+	for _, key := range keys {
+		nanos, err := strconv.ParseInt(strings.TrimPrefix(key, "metering/"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if !time.Unix(0, nanos).Before(cutoff) {
+			break
+		}
+		before = append(before, key)
+	}
+
+	pruned := 0
+	for i := 0; i < len(before)-1; i++ {
+		if err := s.backend.Delete(before[i]); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// Samples the usage of all recorded instances every metering interval until the process ends.
+// Rounds older than METERING_RETENTION are pruned once per meteringPruneInterval.
+func (b *broker) SampleUsage() {
+	var pruned time.Time
+	for {
+		if err := b.sampleUsage(); err != nil {
+			log.Printf("Error sampling usage: %s", err)
+		}
+		if b.env.MeteringRetention > 0 && time.Since(pruned) > meteringPruneInterval {
+			b.pruneMeteringRounds()
+			pruned = time.Now()
+		}
+		time.Sleep(b.env.MeteringInterval)
+	}
+}
+
+const meteringPruneInterval = 24 * time.Hour
+
+func (b *broker) pruneMeteringRounds() {
+	pruned, err := b.state.PruneMeteringRounds(time.Now().Add(-b.env.MeteringRetention))
+	if err != nil {
+		log.Printf("Error pruning usage samples: %s", err)
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d rounds of usage samples", pruned)
+	}
+}
+
+func (b *broker) sampleUsage() error {
+	usage, err := b.sgClient.GetUsage()
+	if err != nil {
+		return fmt.Errorf("Error retrieving usage from storageGrid: %s", err)
+	}
+
+	instances, err := b.state.ListInstances()
+	if err != nil {
+		return fmt.Errorf("Error listing instances: %s", err)
+	}
+
+	round := meteringRound{
+		Time:    time.Now().UTC(),
+		Samples: []usageSample{},
+	}
+
+	for _, rec := range instances {
+		report := bucketsUsage(rec.InstanceID, recordsToBuckets(rec.Buckets), usage)
+		round.Samples = append(round.Samples, usageSample{
+			InstanceID:       rec.InstanceID,
+			OrganizationGUID: rec.OrganizationGUID,
+			SpaceGUID:        rec.SpaceGUID,
+			PlanID:           rec.PlanID,
+			ObjectCount:      report.ObjectCount,
+			DataBytes:        report.DataBytes,
+		})
+	}
+
+	return b.state.PutMeteringRound(round)
+}
+
+// Aggregates the rounds per instance, space or org. The usage sampled in a round counts until the next round, so gaps between rounds
+// (the broker was down, the interval was changed) are accounted for. The last round counts for one metering interval.
+// rounds have to be sorted by time, the rounds before and after the range only count for the part of the range they cover.
+func aggregateUsage(rounds []meteringRound, groupBy string, from, to time.Time, interval time.Duration) ([]meteringRecord, error) {
+	keyOf := map[string]func(usageSample) meteringRecord{
+		"instance": func(s usageSample) meteringRecord {
+			return meteringRecord{InstanceID: s.InstanceID, OrganizationGUID: s.OrganizationGUID, SpaceGUID: s.SpaceGUID}
+		},
+		"space": func(s usageSample) meteringRecord {
+			return meteringRecord{OrganizationGUID: s.OrganizationGUID, SpaceGUID: s.SpaceGUID}
+		},
+		"org": func(s usageSample) meteringRecord {
+			return meteringRecord{OrganizationGUID: s.OrganizationGUID}
+		},
+	}[groupBy]
+	if keyOf == nil {
+		return nil, fmt.Errorf("Unknown group_by %s. Use instance, space or org", groupBy)
+	}
+
+	records := make(map[meteringRecord]*meteringRecord)
+	hours := make(map[meteringRecord]float64) //covered by the rounds of every group, to average over
+	for i, round := range rounds {
+		until := round.Time.Add(interval)
+		if i+1 < len(rounds) {
+			until = rounds[i+1].Time
+		}
+
+		sampled := !round.Time.Before(from) && round.Time.Before(to)
+		covered := overlap(round.Time, until, from, to).Hours()
+		if !sampled && covered == 0 {
+			continue
+		}
+
+		//the usage of every group in this round
+		roundBytes := make(map[meteringRecord]int64)
+		for _, sample := range round.Samples {
+			roundBytes[keyOf(sample)] += sample.DataBytes
+		}
+
+		for key, bytes := range roundBytes {
+			rec, ok := records[key]
+			if !ok {
+				rec = &meteringRecord{}
+				*rec = key
+				rec.From = from
+				rec.To = to
+				records[key] = rec
+			}
+
+			if sampled {
+				rec.Samples++
+			}
+			if bytes > rec.PeakBytes {
+				rec.PeakBytes = bytes
+			}
+			rec.GBHours += float64(bytes) / bytesPerGB * covered
+			hours[key] += covered
+		}
+	}
+
+	result := []meteringRecord{}
+	for key, rec := range records {
+		if hours[key] > 0 {
+			rec.AverageBytes = int64(rec.GBHours * bytesPerGB / hours[key])
+		}
+		result = append(result, *rec)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.OrganizationGUID != b.OrganizationGUID {
+			return a.OrganizationGUID < b.OrganizationGUID
+		}
+		if a.SpaceGUID != b.SpaceGUID {
+			return a.SpaceGUID < b.SpaceGUID
+		}
+		return a.InstanceID < b.InstanceID
+	})
+
+	return result, nil
+}
+
+// Returns how much of [start, end) falls within [from, to)
+func overlap(start, end, from, to time.Time) time.Duration {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
+
+func writeMeteringCSV(w http.ResponseWriter, records []meteringRecord) {
+	w.Header().Set("Content-Type", "text/csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"organization_guid", "space_guid", "instance_id", "from", "to", "samples", "average_bytes", "peak_bytes", "gb_hours"})
+	for _, rec := range records {
+		cw.Write([]string{
+			rec.OrganizationGUID,
+			rec.SpaceGUID,
+			rec.InstanceID,
+			rec.From.Format(time.RFC3339),
+			rec.To.Format(time.RFC3339),
+			strconv.Itoa(rec.Samples),
+			strconv.FormatInt(rec.AverageBytes, 10),
+			strconv.FormatInt(rec.PeakBytes, 10),
+			strconv.FormatFloat(rec.GBHours, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+}
+
+// Exports usage over a time range: ?from=<RFC3339>&to=<RFC3339>&group_by=instance|space|org&format=json|csv
+// The range defaults to the previous calendar month, grouping to instance and the format to json.
+func (a adminAPI) MeteringHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	if a.b.state == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "No state store configured")
+		return
+	}
+
+	query := r.URL.Query()
+
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, -1, 0)
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid from: %s", err)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid to: %s", err)
+			return
+		}
+	}
+
+	if !to.After(from) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "to has to be after from")
+		return
+	}
+
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = "instance"
+	}
+
+	rounds, err := a.b.state.ListMeteringRounds(from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error retrieving usage samples: %s", err)
+		return
+	}
+
+	records, err := aggregateUsage(rounds, groupBy, from, to, a.b.env.MeteringInterval)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		json.NewEncoder(w).Encode(records)
+	case "csv":
+		writeMeteringCSV(w, records)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown format. Use json or csv")
+	}
+}
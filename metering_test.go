@@ -0,0 +1,198 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAggregateUsage(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(hours float64) time.Time { return from.Add(time.Duration(hours * float64(time.Hour))) }
+
+	sample := func(instanceID, org string, gb int64) usageSample {
+		return usageSample{InstanceID: instanceID, OrganizationGUID: org, DataBytes: gb * bytesPerGB}
+	}
+
+	tests := []struct {
+		name        string
+		rounds      []meteringRound
+		groupBy     string
+		wantGBHours map[string]float64 //by instance or org
+		wantSamples map[string]int
+	}{
+		{
+			name: "regular rounds",
+			rounds: []meteringRound{
+				{Time: at(0), Samples: []usageSample{sample("a", "org", 1)}},
+				{Time: at(1), Samples: []usageSample{sample("a", "org", 3)}},
+			},
+			groupBy:     "instance",
+			wantGBHours: map[string]float64{"a": 1 + 3},
+			wantSamples: map[string]int{"a": 2},
+		},
+		{
+			name: "gap between rounds",
+			rounds: []meteringRound{
+				{Time: at(0), Samples: []usageSample{sample("a", "org", 2)}},
+				{Time: at(5), Samples: []usageSample{sample("a", "org", 2)}},
+			},
+			groupBy:     "instance",
+			wantGBHours: map[string]float64{"a": 2*5 + 2*1},
+			wantSamples: map[string]int{"a": 2},
+		},
+		{
+			name: "rounds around the range",
+			rounds: []meteringRound{
+				{Time: at(-1.5), Samples: []usageSample{sample("a", "org", 4)}},
+				{Time: at(0.5), Samples: []usageSample{sample("a", "org", 2)}},
+				{Time: at(9.5), Samples: []usageSample{sample("a", "org", 1)}},
+				{Time: at(10.5), Samples: []usageSample{sample("b", "org", 1)}},
+			},
+			groupBy:     "instance",
+			wantGBHours: map[string]float64{"a": 4*0.5 + 2*9 + 1*0.5},
+			wantSamples: map[string]int{"a": 2},
+		},
+		{
+			name: "grouped by org",
+			rounds: []meteringRound{
+				{Time: at(0), Samples: []usageSample{sample("a", "x", 1), sample("b", "x", 2), sample("c", "y", 5)}},
+			},
+			groupBy:     "org",
+			wantGBHours: map[string]float64{"x": 3, "y": 5},
+			wantSamples: map[string]int{"x": 1, "y": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := aggregateUsage(tt.rounds, tt.groupBy, from, to, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.wantGBHours) {
+				t.Fatalf("got %d records, want %d: %+v", len(records), len(tt.wantGBHours), records)
+			}
+
+			for _, rec := range records {
+				key := rec.InstanceID
+				if tt.groupBy == "org" {
+					key = rec.OrganizationGUID
+				}
+
+				if want := tt.wantGBHours[key]; math.Abs(rec.GBHours-want) > 0.001 {
+					t.Errorf("%s: got %.3f GB-hours, want %.3f", key, rec.GBHours, want)
+				}
+				if want := tt.wantSamples[key]; rec.Samples != want {
+					t.Errorf("%s: got %d samples, want %d", key, rec.Samples, want)
+				}
+			}
+		})
+	}
+
+	if _, err := aggregateUsage(nil, "cluster", from, to, time.Hour); err == nil {
+		t.Error("expected an error for an unknown group_by")
+	}
+}
+
+func TestListMeteringRounds(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, hours := range []int{-3, -1, 0, 5, 10, 12} {
+		if err := state.PutMeteringRound(meteringRound{Time: from.Add(time.Duration(hours) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rounds, err := state.ListMeteringRounds(from, from.Add(10*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for _, round := range rounds {
+		got = append(got, int(round.Time.Sub(from).Hours()))
+	}
+	if want := []int{-1, 0, 5, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rounds at %v hours, want %v", got, want)
+	}
+}
+
+func TestMeteringHandlerRange(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := adminAPI{b: &broker{state: NewStateStore(backend), env: brokerConfig{MeteringInterval: time.Hour}}, username: "user", password: "password"}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"default range", "", http.StatusOK},
+		{"range", "from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z", http.StatusOK},
+		{"empty range", "from=2024-01-01T00:00:00Z&to=2024-01-01T00:00:00Z", http.StatusBadRequest},
+		{"reversed range", "from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z", http.StatusBadRequest},
+		{"invalid from", "from=yesterday", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/metering?"+tt.query, nil)
+			req.SetBasicAuth("user", "password")
+
+			rec := httptest.NewRecorder()
+			a.MeteringHandler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got status %d (%s), want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneMeteringRounds(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, hours := range []int{-3, -2, -1, 0, 5} {
+		if err := state.PutMeteringRound(meteringRound{Time: cutoff.Add(time.Duration(hours) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := state.PruneMeteringRounds(cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("pruned %d rounds, want 2", pruned)
+	}
+
+	rounds, err := state.ListMeteringRounds(cutoff.Add(-24*time.Hour), cutoff.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for _, round := range rounds {
+		got = append(got, int(round.Time.Sub(cutoff).Hours()))
+	}
+	if want := []int{-1, 0, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rounds at %v hours, want %v", got, want)
+	}
+}
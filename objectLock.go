@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// ProvisionParamsObjectLock requests a bucket with S3 Object Lock (WORM) and the default retention of new objects
+type ProvisionParamsObjectLock struct {
+	Mode string `json:"mode"` //governance or compliance
+	Days int64  `json:"days"`
+}
+
+// objectLockConfig is the default retention of a bucket. The zero value means Object Lock is not enabled.
+type objectLockConfig struct {
+	mode string //s3.ObjectLockRetentionModeGovernance or s3.ObjectLockRetentionModeCompliance
+	days int64
+}
+
+// Object Lock without a default retention. This is how a bucket is reported before its retention is set.
+var objectLockWithoutRetention = objectLockConfig{mode: s3.ObjectLockRetentionModeGovernance}
+
+func (c objectLockConfig) enabled() bool {
+	return c.mode != ""
+}
+
+func (c objectLockConfig) params() *ProvisionParamsObjectLock {
+	if !c.enabled() {
+		return nil
+	}
+
+	return &ProvisionParamsObjectLock{
+		Mode: strings.ToLower(c.mode),
+		Days: c.days,
+	}
+}
+
+// Validates the object_lock parameter of a bucket
+func parseObjectLockParam(bucketName string, param *ProvisionParamsObjectLock) (objectLockConfig, error) {
+	if param == nil {
+		return objectLockConfig{}, nil
+	}
+
+	mode := strings.ToUpper(param.Mode)
+	if mode != s3.ObjectLockRetentionModeGovernance && mode != s3.ObjectLockRetentionModeCompliance {
+		return objectLockConfig{}, errInvalidObjectLock(fmt.Errorf("Invalid Object Lock mode \"%s\" for bucket %s. Use governance or compliance", param.Mode, bucketName))
+	}
+
+	if param.Days <= 0 {
+		return objectLockConfig{}, errInvalidObjectLock(fmt.Errorf("The Object Lock retention of bucket %s has to be at least 1 day", bucketName))
+	}
+
+	return objectLockConfig{
+		mode: mode,
+		days: param.Days,
+	}, nil
+}
+
+// Object Lock can only be enabled when a bucket is created and the retention can only get stricter: longer, or from governance to compliance
+func checkObjectLockChange(bucketName string, current, requested objectLockConfig) error {
+	switch {
+	case !current.enabled() && requested.enabled():
+		return errInvalidObjectLock(fmt.Errorf("Object Lock can't be enabled on the existing bucket %s. It can only be enabled for new buckets", bucketName))
+	case current.enabled() && !requested.enabled():
+		return errInvalidObjectLock(fmt.Errorf("Object Lock can't be disabled on bucket %s", bucketName))
+	case !current.enabled():
+		return nil
+	case requested.days < current.days:
+		return errInvalidObjectLock(fmt.Errorf("The retention of bucket %s can't be shortened from %d to %d days", bucketName, current.days, requested.days))
+	case current.mode == s3.ObjectLockRetentionModeCompliance && requested.mode != s3.ObjectLockRetentionModeCompliance:
+		return errInvalidObjectLock(fmt.Errorf("The retention mode of bucket %s can't be changed from compliance to governance", bucketName))
+	}
+
+	return nil
+}
+
+func errInvalidObjectLock(err error) error {
+	return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-object-lock")
+}
+
+// Refuses to delete buckets with Object Lock that still hold object versions. Those versions can't be deleted before their retention ends.
+// The lock is looked up in S3 so buckets locked outside the broker are refused as well.
+func (b *broker) refuseLockedBuckets(buckets map[string]Bucket) error {
+	var locked []string
+	for friendlyName, bckt := range buckets {
+		lock, err := b.s3client.GetObjectLockConfiguration(bckt.name)
+		if err != nil {
+			return fmt.Errorf("Unable to determine Object Lock for bucket %s. %s", bckt.name, err)
+		}
+		if !lock.enabled() {
+			continue
+		}
+
+		hasObjects, err := b.s3client.BucketHasObjectVersions(bckt.name)
+		if err != nil {
+			return fmt.Errorf("Unable to list object versions of bucket %s. %s", bckt.name, err)
+		}
+		if hasObjects {
+			locked = append(locked, friendlyName)
+		}
+	}
+
+	if len(locked) > 0 {
+		err := fmt.Errorf("Buckets with Object Lock can't be deleted while they hold objects. Object versions can only be deleted once their retention has ended: %s", strings.Join(locked, ", "))
+		return apiresponses.NewFailureResponse(err, http.StatusUnprocessableEntity, "bucket-locked")
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseObjectLockParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   *ProvisionParamsObjectLock
+		want    objectLockConfig
+		wantErr bool
+	}{
+		{"not requested", nil, objectLockConfig{}, false},
+		{"governance", &ProvisionParamsObjectLock{Mode: "governance", Days: 30}, objectLockConfig{mode: "GOVERNANCE", days: 30}, false},
+		{"compliance", &ProvisionParamsObjectLock{Mode: "COMPLIANCE", Days: 1}, objectLockConfig{mode: "COMPLIANCE", days: 1}, false},
+		{"unknown mode", &ProvisionParamsObjectLock{Mode: "legal-hold", Days: 30}, objectLockConfig{}, true},
+		{"no retention", &ProvisionParamsObjectLock{Mode: "governance"}, objectLockConfig{}, true},
+		{"negative retention", &ProvisionParamsObjectLock{Mode: "governance", Days: -1}, objectLockConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseObjectLockParam("bucket", tt.param)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			//the parameters reported back to the platform
+			if p := got.params(); tt.param != nil && !tt.wantErr && (p == nil || !strings.EqualFold(p.Mode, tt.param.Mode) || p.Days != tt.param.Days) {
+				t.Errorf("params of %+v: got %+v", got, p)
+			}
+		})
+	}
+}
+
+func TestCheckObjectLockChange(t *testing.T) {
+	governance30 := objectLockConfig{mode: "GOVERNANCE", days: 30}
+	compliance30 := objectLockConfig{mode: "COMPLIANCE", days: 30}
+
+	tests := []struct {
+		name      string
+		current   objectLockConfig
+		requested objectLockConfig
+		wantErr   bool
+	}{
+		{"no lock", objectLockConfig{}, objectLockConfig{}, false},
+		{"unchanged", governance30, governance30, false},
+		{"longer", governance30, objectLockConfig{mode: "GOVERNANCE", days: 60}, false},
+		{"governance to compliance", governance30, compliance30, false},
+		{"retention on a new bucket", objectLockWithoutRetention, governance30, false},
+		{"shorter", governance30, objectLockConfig{mode: "GOVERNANCE", days: 10}, true},
+		{"compliance to governance", compliance30, governance30, true},
+		{"enabled on an existing bucket", objectLockConfig{}, governance30, true},
+		{"disabled", governance30, objectLockConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkObjectLockChange("bucket", tt.current, tt.requested); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+type operationType string
+
+const (
+	operationProvision   operationType = "provision"
+	operationUpdate      operationType = "update"
+	operationDeprovision operationType = "deprovision"
+)
+
+// operation keeps track of the progress of a single (possibly asynchronous) broker operation on an instance
+type operation struct {
+	ID         string
+	InstanceID string
+	Type       operationType
+	State      domain.LastOperationState
+	Error      string
+	Buckets    map[string]string
+	Steps      []string
+	Target     *instanceRecord
+	Delete     map[string]bucketRecord
+	Resources  []journalResource
+	Started    time.Time
+	Finished   time.Time
+	owner      string
+	state      *stateStore
+	mutex      sync.Mutex
+}
+
+// operationTracker keeps the operations running in this broker instance. With a state store every operation is journaled under a lease
+// that is renewed while the operation runs, so another broker instance can take over operations of an instance that died.
+type operationTracker struct {
+	operations map[string]*operation
+	leased     map[string]*operation
+	state      *stateStore
+	owner      string
+	mutex      sync.Mutex
+}
+
+// How long an operation stays claimed by a broker instance without the lease being renewed
+const operationLease = 2 * time.Minute
+
+func newOperation(instanceID string, opType operationType) *operation {
+	return &operation{
+		ID:         strings.ReplaceAll(uuid.New().String(), "-", ""),
+		InstanceID: instanceID,
+		Type:       opType,
+		State:      domain.InProgress,
+		Buckets:    make(map[string]string),
+		Started:    time.Now(),
+	}
+}
+
+// Creates a tracker. When state is not nil every operation is also recorded in the state store.
+func newOperationTracker(state *stateStore) *operationTracker {
+	return &operationTracker{
+		operations: make(map[string]*operation),
+		leased:     make(map[string]*operation),
+		state:      state,
+		owner:      brokerInstanceID(),
+		mutex:      sync.Mutex{},
+	}
+}
+
+// Identifies this broker instance as the owner of operations
+func brokerInstanceID() string {
+	if id := os.Getenv("CF_INSTANCE_GUID"); id != "" {
+		return id
+	}
+
+	return uuid.New().String()
+}
+
+// Returns true for the first broker instance, which runs the jobs that must not run in more than one broker instance: taking over operations
+// of other broker instances and sampling usage. The state store backends have no compare-and-swap, two instances could take over the same
+// operation. On Cloud Foundry this is the instance with index 0, which Diego restarts in place when it dies. Outside Cloud Foundry every broker
+// is assumed to run alone.
+func firstBrokerInstance() bool {
+	index := os.Getenv("CF_INSTANCE_INDEX")
+	return index == "" || index == "0"
+}
+
+// Creates a new operation which is recorded in the operation history but not tracked as the running operation of the instance. Used for synchronous operations.
+func (t *operationTracker) New(instanceID string, opType operationType) *operation {
+	op := newOperation(instanceID, opType)
+	op.state = t.state
+	op.owner = t.owner
+
+	op.mutex.Lock()
+	op.save()
+	op.mutex.Unlock()
+
+	t.mutex.Lock()
+	t.leased[op.ID] = op
+	t.mutex.Unlock()
+
+	return op
+}
+
+// Starts tracking a new operation for an instance. Any earlier operation on the same instance is forgotten.
+func (t *operationTracker) Start(instanceID string, opType operationType) *operation {
+	op := t.New(instanceID, opType)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.operations[instanceID] = op
+
+	return op
+}
+
+// Takes over an unfinished operation from the journal. Only called by the first broker instance, see firstBrokerInstance.
+func (t *operationTracker) Resume(rec operationRecord) *operation {
+	op := &operation{
+		ID:         rec.ID,
+		InstanceID: rec.InstanceID,
+		Type:       rec.Type,
+		State:      domain.InProgress,
+		Buckets:    make(map[string]string),
+		Steps:      rec.Steps,
+		Target:     rec.Target,
+		Delete:     rec.Delete,
+		Resources:  rec.Resources,
+		Started:    rec.Started,
+		owner:      t.owner,
+		state:      t.state,
+	}
+
+	op.mutex.Lock()
+	op.Steps = append(op.Steps, fmt.Sprintf("taken over by %s", t.owner))
+	op.save()
+	op.mutex.Unlock()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.operations[rec.InstanceID] = op
+	t.leased[op.ID] = op
+
+	return op
+}
+
+// Renews the leases of the operations running in this broker instance until the process ends
+func (t *operationTracker) RenewLeases() {
+	for range time.Tick(operationLease / 4) {
+		t.mutex.Lock()
+		var leased []*operation
+		for _, op := range t.leased {
+			leased = append(leased, op)
+		}
+		t.mutex.Unlock()
+
+		for _, op := range leased {
+			op.mutex.Lock()
+			running := op.State == domain.InProgress
+			if running {
+				op.save()
+			}
+			op.mutex.Unlock()
+
+			if !running {
+				t.mutex.Lock()
+				delete(t.leased, op.ID)
+				t.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// Returns the state of an operation. Operations started by another broker instance (or before a restart) are looked up in the state store.
+func (t *operationTracker) LastOperation(instanceID, operationData string) (domain.LastOperation, bool) {
+	if op, ok := t.Get(instanceID, operationData); ok {
+		return op.LastOperation(), true
+	}
+
+	if t.state == nil {
+		return domain.LastOperation{}, false
+	}
+
+	rec, err := t.state.GetOperation(instanceID, operationData)
+	if err != nil {
+		if err != errKeyNotFound {
+			log.Printf("Error retrieving operation %s for instance %s: %s", operationData, instanceID, err)
+		}
+		return domain.LastOperation{}, false
+	}
+
+	return domain.LastOperation{
+		State:       rec.State,
+		Description: rec.Description,
+	}, true
+}
+
+// Returns the operation for an instance. When operationData is set it has to match the tracked operation.
+func (t *operationTracker) Get(instanceID, operationData string) (*operation, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	op, ok := t.operations[instanceID]
+	if !ok {
+		return nil, false
+	}
+
+	if operationData != "" && op.OperationData() != operationData {
+		return nil, false
+	}
+
+	return op, true
+}
+
+// Returns true if an operation is still running for the instance
+func (t *operationTracker) InProgress(instanceID string) bool {
+	op, ok := t.Get(instanceID, "")
+	if !ok {
+		return false
+	}
+
+	return op.LastOperation().State == domain.InProgress
+}
+
+// Returns true if an operation is still running for the instance on this or, according to the journal, another broker instance
+func (t *operationTracker) Unfinished(instanceID string) bool {
+	_, unfinished := t.Running(instanceID)
+	return unfinished
+}
+
+// Returns the type of the operation still running for the instance on this or, according to the journal, another broker instance.
+// When the journal can't be read the operation is assumed to be running, its type is empty then.
+func (t *operationTracker) Running(instanceID string) (operationType, bool) {
+	if op, ok := t.Get(instanceID, ""); ok && op.LastOperation().State == domain.InProgress {
+		return op.Type, true
+	}
+
+	if t.state == nil {
+		return "", false
+	}
+
+	rec, err := t.state.GetOperation(instanceID, "")
+	if err != nil {
+		if err != errKeyNotFound {
+			log.Printf("Error retrieving operations of instance %s: %s", instanceID, err)
+			return "", true
+		}
+		return "", false
+	}
+
+	return rec.Type, rec.State == domain.InProgress
+}
+
+func (o *operation) OperationData() string {
+	return fmt.Sprintf("%s:%s", o.Type, o.ID)
+}
+
+func (o *operation) SetBucketStatus(friendlyName, status string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.Buckets[friendlyName] = status
+	o.save()
+}
+
+// Records a step of the operation so it can be seen what was done (and undone) when the operation fails
+func (o *operation) AddStep(step string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.Steps = append(o.Steps, step)
+	o.save()
+}
+
+// Journals the target state of the instance and the buckets to delete so the operation can be resumed by another broker instance
+func (o *operation) SetJournal(target instanceRecord, del map[string]Bucket) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.Target = &target
+	if len(del) > 0 {
+		o.Delete = bucketsToRecords(del)
+	}
+	o.save()
+}
+
+// Journals a resource created by the operation so it can be compensated
+func (o *operation) AddResource(kind, name string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.Resources = append(o.Resources, journalResource{Kind: kind, Name: name})
+	o.Steps = append(o.Steps, fmt.Sprintf("created %s %s", kind, name))
+	o.save()
+}
+
+// Returns the resources journaled as created by the operation, in the order they were created
+func (o *operation) JournaledResources() []journalResource {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return append([]journalResource(nil), o.Resources...)
+}
+
+func (o *operation) Succeed() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.State = domain.Succeeded
+	o.Finished = time.Now()
+	o.save()
+}
+
+func (o *operation) Fail(err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.State = domain.Failed
+	o.Error = err.Error()
+	o.Finished = time.Now()
+	o.save()
+}
+
+// Converts the operation to an OSB last operation including a description of the state of every bucket
+func (o *operation) LastOperation() domain.LastOperation {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.lastOperation()
+}
+
+// Records the operation in the state store. Caller must hold the mutex.
+func (o *operation) save() {
+	if o.state == nil {
+		return
+	}
+
+	lastOp := o.lastOperation()
+	rec := operationRecord{
+		ID:          o.ID,
+		InstanceID:  o.InstanceID,
+		Type:        o.Type,
+		State:       lastOp.State,
+		Description: lastOp.Description,
+		Steps:       o.Steps,
+		Target:      o.Target,
+		Delete:      o.Delete,
+		Resources:   o.Resources,
+		Owner:       o.owner,
+		Started:     o.Started,
+		Finished:    o.Finished,
+	}
+	if o.State == domain.InProgress {
+		rec.LeaseExpires = time.Now().Add(operationLease)
+	}
+
+	err := o.state.PutOperation(rec)
+	if err != nil {
+		log.Printf("Error recording operation %s for instance %s: %s", o.ID, o.InstanceID, err)
+	}
+}
+
+func (o *operation) lastOperation() domain.LastOperation {
+	var description string
+	switch o.State {
+	case domain.InProgress:
+		description = fmt.Sprintf("%s in progress.", o.Type)
+	case domain.Succeeded:
+		description = fmt.Sprintf("%s succeeded.", o.Type)
+	case domain.Failed:
+		description = fmt.Sprintf("%s failed: %s.", o.Type, o.Error)
+	}
+
+	friendlyNames := make([]string, 0, len(o.Buckets))
+	for friendlyName := range o.Buckets {
+		friendlyNames = append(friendlyNames, friendlyName)
+	}
+	sort.Strings(friendlyNames)
+
+	var bucketStatus []string
+	for _, friendlyName := range friendlyNames {
+		bucketStatus = append(bucketStatus, fmt.Sprintf("%s: %s", friendlyName, o.Buckets[friendlyName]))
+	}
+
+	if len(bucketStatus) > 0 {
+		description = fmt.Sprintf("%s Buckets: %s", description, strings.Join(bucketStatus, ", "))
+	}
+
+	return domain.LastOperation{
+		State:       o.State,
+		Description: description,
+	}
+}
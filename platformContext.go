@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// storageGrid limits the display name of a group
+const maxDisplayNameLength = 128
+
+// S3 tag values only allow letters, digits, spaces and + - = . _ : / @
+var invalidTagChars = regexp.MustCompile(`[^\p{L}\p{N} +\-=._:/@]`)
+
+// platformContext is the OSB context sent by the platform with provision and update requests
+type platformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	OrganizationName string `json:"organization_name"`
+	SpaceGUID        string `json:"space_guid"`
+	SpaceName        string `json:"space_name"`
+	InstanceName     string `json:"instance_name"`
+}
+
+// Returns the platform context, or an empty one when it's missing or invalid
+func parsePlatformContext(rawContext json.RawMessage) platformContext {
+	var pc platformContext
+	if len(rawContext) > 0 {
+		json.Unmarshal(rawContext, &pc)
+	}
+
+	return pc
+}
+
+// Returns a display name for the group of an instance that tells operators where the instance belongs, e.g. "cloudfoundry: org/space/instance".
+// Falls back to the group name when the platform didn't send names.
+func (pc platformContext) displayName(groupName string) string {
+	if pc.InstanceName == "" {
+		return groupName
+	}
+
+	var path []string
+	for _, name := range []string{pc.OrganizationName, pc.SpaceName, pc.InstanceName} {
+		if name != "" {
+			path = append(path, name)
+		}
+	}
+
+	name := strings.Join(path, "/")
+	if pc.Platform != "" {
+		name = fmt.Sprintf("%s: %s", pc.Platform, name)
+	}
+
+	//a leading "[" marks access level and binding groups, see isBindingGroup
+	name = strings.TrimLeft(name, "[")
+
+	if runes := []rune(name); len(runes) > maxDisplayNameLength {
+		name = string(runes[:maxDisplayNameLength])
+	}
+
+	return name
+}
+
+// Returns the tags the broker maintains on every bucket of an instance
+func (pc platformContext) bucketTags(instanceID string) map[string]string {
+	tags := map[string]string{
+		"instance-id": instanceID,
+	}
+
+	for key, value := range map[string]string{
+		"platform":      pc.Platform,
+		"org-guid":      pc.OrganizationGUID,
+		"org-name":      pc.OrganizationName,
+		"space-guid":    pc.SpaceGUID,
+		"space-name":    pc.SpaceName,
+		"instance-name": pc.InstanceName,
+	} {
+		if value != "" {
+			tags[key] = tagValue(value)
+		}
+	}
+
+	return tags
+}
+
+// Replaces characters S3 doesn't allow in tag values and cuts the value to the maximum length of 256
+func tagValue(value string) string {
+	value = invalidTagChars.ReplaceAllString(value, "_")
+	if runes := []rune(value); len(runes) > 256 {
+		value = string(runes[:256])
+	}
+
+	return value
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// Plans set the capacity of an instance with "quota_gb" in the plan metadata. Plans without it are unlimited.
+const planQuotaKey = "quota_gb"
+
+const bytesPerGB = 1000 * 1000 * 1000
+
+// Returns the quota of a plan in bytes, 0 when the plan is unlimited
+func (b *broker) planQuota(planID string) int64 {
+	for _, service := range b.services {
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return int64(servicePlanQuotaGB(plan) * bytesPerGB)
+			}
+		}
+	}
+
+	return 0
+}
+
+// Returns the "quota_gb" of a plan, 0 when the plan is unlimited
+func servicePlanQuotaGB(plan brokerapi.ServicePlan) float64 {
+	if plan.Metadata == nil {
+		return 0
+	}
+
+	quotaGB, _ := plan.Metadata.AdditionalMetadata[planQuotaKey].(float64)
+	return quotaGB
+}
+
+// Quotas are only enforced with a state store, without one the plans with a quota are left out of the catalog
+func withoutQuotaPlans(services []brokerapi.Service) []brokerapi.Service {
+	filtered := make([]brokerapi.Service, 0, len(services))
+	for _, service := range services {
+		plans := make([]brokerapi.ServicePlan, 0, len(service.Plans))
+		for _, plan := range service.Plans {
+			if servicePlanQuotaGB(plan) > 0 {
+				continue
+			}
+			plans = append(plans, plan)
+		}
+
+		service.Plans = plans
+		filtered = append(filtered, service)
+	}
+
+	return filtered
+}
+
+// Returns the quota requested with the "quota_gb" parameter in bytes, 0 when none was requested
+func getQuotaParam(rawParams json.RawMessage) int64 {
+	if len(rawParams) == 0 {
+		return 0
+	}
+
+	var params ProvisionParameters
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return 0
+	}
+
+	return params.QuotaGB * bytesPerGB
+}
+
+// A quota parameter can only lower the quota of the plan. Quotas are refused without a state store, they're enforced for the recorded instances only.
+func (b *broker) validateQuotaParam(planID string, rawParams json.RawMessage) error {
+	requested := getQuotaParam(rawParams)
+	if requested < 0 {
+		return apiresponses.NewFailureResponse(fmt.Errorf("quota_gb can't be negative"), http.StatusBadRequest, "invalid-quota")
+	}
+
+	plan := b.planQuota(planID)
+	if b.state == nil && (plan > 0 || requested > 0) {
+		return apiresponses.NewFailureResponse(fmt.Errorf("Quotas can't be enforced because the broker has no state store configured. Use a plan without a quota and don't set quota_gb"), http.StatusUnprocessableEntity, "quota-unsupported")
+	}
+
+	if requested > 0 && plan > 0 && requested > plan {
+		return apiresponses.NewFailureResponse(fmt.Errorf("quota_gb can't be larger than the %d GB of the plan", plan/bytesPerGB), http.StatusBadRequest, "invalid-quota")
+	}
+
+	return nil
+}
+
+// Returns the effective quota of an instance in bytes, 0 when it's unlimited
+func (b *broker) instanceQuota(rec instanceRecord) int64 {
+	quota := b.planQuota(rec.PlanID)
+	if requested := getQuotaParam(rec.Parameters); requested > 0 && (quota == 0 || requested < quota) {
+		quota = requested
+	}
+
+	return quota
+}
+
+// Checks the usage of all recorded instances against their quota until the process ends. Runs on the first broker instance only, it's the only one writing the quota state.
+func (b *broker) EnforceQuotas() {
+	for {
+		b.enforceQuotas()
+		time.Sleep(b.env.QuotaCheckInterval)
+	}
+}
+
+func (b *broker) enforceQuotas() {
+	usage, err := b.sgClient.GetUsage()
+	if err != nil {
+		log.Printf("Error retrieving usage from storageGrid: %s", err)
+		return
+	}
+
+	instances, err := b.state.ListInstances()
+	if err != nil {
+		log.Printf("Error listing instances: %s", err)
+		return
+	}
+
+	for _, listed := range instances {
+		if b.operations.Unfinished(listed.InstanceID) {
+			continue
+		}
+
+		//the usage was retrieved first, the record may have changed since it was listed
+		rec, err := b.state.GetInstance(listed.GroupName)
+		if err != nil {
+			if err != errKeyNotFound {
+				log.Printf("Error retrieving instance %s: %s", listed.InstanceID, err)
+			}
+			continue
+		}
+
+		quota := b.instanceQuota(rec)
+		exceeded := quota > 0 && bucketsUsage(rec.InstanceID, recordsToBuckets(rec.Buckets), usage).DataBytes > quota
+
+		if err := b.setQuotaExceeded(rec, exceeded); err != nil {
+			log.Printf("Error enforcing quota of instance %s: %s", rec.InstanceID, err)
+		}
+	}
+}
+
+// Swaps the policies of all groups of an instance to deny (or allow again) uploads. Does nothing when the policies are already up to date.
+func (b *broker) setQuotaExceeded(rec instanceRecord, exceeded bool) error {
+	changed := false
+	buckets := recordsToBuckets(rec.Buckets)
+	for friendlyName, bckt := range buckets {
+		if bckt.quotaExceeded != exceeded {
+			bckt.quotaExceeded = exceeded
+			buckets[friendlyName] = bckt
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if exceeded {
+		log.Printf("Instance %s exceeds its quota, denying uploads", rec.InstanceID)
+	} else {
+		log.Printf("Instance %s is within its quota again, allowing uploads", rec.InstanceID)
+	}
+
+	//1. the instance group and the access level groups
+	grp, err := b.sgClient.GetGroupByName(rec.GroupName)
+	if err != nil {
+		return fmt.Errorf("Error getting group from storageGrid: %s", err)
+	}
+
+	policy, err := GenerateS3Policy(rec.GroupName, buckets)
+	if err != nil {
+		return fmt.Errorf("Generating policy failed: %s", err)
+	}
+
+	if _, err := b.sgClient.UpdateGroupPolicy(grp, policy); err != nil {
+		return fmt.Errorf("Error updating group policy: %s", err)
+	}
+
+	if err := b.updateAccessGroups(rec.GroupName, buckets); err != nil {
+		return fmt.Errorf("Error updating access group policies: %s", err)
+	}
+
+	//2. the groups of bindings restricted to some buckets or prefixes
+	if err := b.updateBindingGroups(rec, buckets); err != nil {
+		return err
+	}
+
+	//3. remember the state so it's kept by updates and reconciliation
+	return b.recordInstance(rec, buckets)
+}
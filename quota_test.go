@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+func TestValidateQuotaParam(t *testing.T) {
+	services, err := CatalogLoad("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		standard = "a31fec23-a86b-4d3a-87d2-f44b620b9c04"
+		tenGB    = "8d672b36-cbad-4360-a918-63e6244a2c80"
+	)
+
+	tests := []struct {
+		name    string
+		state   *stateStore
+		planID  string
+		params  string
+		wantErr bool
+	}{
+		{"unlimited plan", nil, standard, `{}`, false},
+		{"lower quota", NewStateStore(backend), tenGB, `{"quota_gb": 5}`, false},
+		{"quota above plan", NewStateStore(backend), tenGB, `{"quota_gb": 20}`, true},
+		{"negative quota", NewStateStore(backend), standard, `{"quota_gb": -1}`, true},
+		{"quota plan without state store", nil, tenGB, `{}`, true},
+		{"quota parameter without state store", nil, standard, `{"quota_gb": 5}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &broker{services: services, state: tt.state}
+			if err := b.validateQuotaParam(tt.planID, json.RawMessage(tt.params)); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdatedPlanID(t *testing.T) {
+	tests := []struct {
+		name     string
+		details  domain.UpdateDetails
+		recorded string
+		want     string
+	}{
+		{"plan changed", domain.UpdateDetails{PlanID: "new", PreviousValues: domain.PreviousValues{PlanID: "old"}}, "old", "new"},
+		{"no plan_id", domain.UpdateDetails{PreviousValues: domain.PreviousValues{PlanID: "previous"}}, "recorded", "recorded"},
+		{"no plan_id and no record", domain.UpdateDetails{PreviousValues: domain.PreviousValues{PlanID: "previous"}}, "", "previous"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := updatedPlanID(tt.details, instanceRecord{PlanID: tt.recorded}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutQuotaPlans(t *testing.T) {
+	services, err := CatalogLoad("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, service := range services {
+		total += len(service.Plans)
+	}
+
+	filtered := withoutQuotaPlans(services)
+	kept := 0
+	for _, service := range filtered {
+		for _, plan := range service.Plans {
+			if servicePlanQuotaGB(plan) > 0 {
+				t.Errorf("plan %s with a quota was kept", plan.Name)
+			}
+			kept++
+		}
+	}
+
+	if kept == 0 || kept == total {
+		t.Errorf("kept %d of %d plans, want only the plans without a quota", kept, total)
+	}
+
+	unchanged := 0
+	for _, service := range services {
+		unchanged += len(service.Plans)
+	}
+	if unchanged != total {
+		t.Errorf("the loaded catalog was modified")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type reconcileResult struct {
+	InstanceID string   `json:"instance_id"`
+	Actions    []string `json:"actions"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Makes storageGrid match the recorded state of an instance: the group and its policy, the access and binding groups, the buckets with their tags, retention, configuration and versioning.
+// Returns the actions taken. When op is not nil the group and buckets that had to be created are journaled as resources of op.
+func (b *broker) reconcileInstance(rec instanceRecord, op *operation) ([]string, error) {
+	actions := []string{}
+	buckets := recordsToBuckets(rec.Buckets)
+
+	policy, err := GenerateS3Policy(rec.GroupName, buckets)
+	if err != nil {
+		return actions, fmt.Errorf("Generating policy failed: %s", err)
+	}
+
+	//1. group and policy
+	grp, err := b.sgClient.GetGroupByName(rec.GroupName)
+	if err != nil {
+		if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+			return actions, fmt.Errorf("Error getting group from storageGrid: %s", err)
+		}
+
+		log.Printf("Reconcile: creating missing group %s", rec.GroupName)
+		if _, err := b.sgClient.CreateGroup(rec.GroupName, parsePlatformContext(rec.Context).displayName(rec.GroupName), policy); err != nil {
+			return actions, fmt.Errorf("Group Creation Failed: %s", err)
+		}
+		if op != nil {
+			op.AddResource("group", rec.GroupName)
+		}
+		actions = append(actions, "created group")
+	} else if !equalPolicies(grp.Policies, policy) {
+		log.Printf("Reconcile: updating policy of group %s", rec.GroupName)
+		if _, err := b.sgClient.UpdateGroupPolicy(grp, policy); err != nil {
+			return actions, fmt.Errorf("Error updating group policy: %s", err)
+		}
+		actions = append(actions, "updated group policy")
+	}
+
+	if err := b.updateAccessGroups(rec.GroupName, buckets); err != nil {
+		return actions, fmt.Errorf("Error updating access group policies: %s", err)
+	}
+
+	if err := b.updateBindingGroups(rec, buckets); err != nil {
+		return actions, err
+	}
+
+	//2. buckets
+	for friendlyName, bckt := range buckets {
+		_, err := b.s3client.GetBucketRegion(bckt.name)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchBucket {
+				return actions, fmt.Errorf("Unable to determine region for bucket %s. %s", bckt.name, err)
+			}
+
+			log.Printf("Reconcile: creating missing bucket %s", bckt.name)
+			if _, err := b.s3client.CreateBucket(bckt.name, bckt.region, bckt.objectLock.enabled()); err != nil {
+				return actions, fmt.Errorf("Creating bucket %s failed with error: %s", bckt.name, err)
+			}
+			if op != nil {
+				op.AddResource("bucket", bckt.name)
+			}
+			actions = append(actions, fmt.Sprintf("created bucket %s", friendlyName))
+		}
+
+		tags, err := b.s3client.GetBucketTagging(bckt.name)
+		if err != nil {
+			return actions, fmt.Errorf("Unable to determine tags for bucket %s. %s", bckt.name, err)
+		}
+		if wanted := bucketTagSet(rec, bckt); !reflect.DeepEqual(tags, wanted) {
+			log.Printf("Reconcile: tagging bucket %s", bckt.name)
+			if err := b.s3client.PutBucketTagging(bckt.name, wanted); err != nil {
+				return actions, fmt.Errorf("Tagging bucket %s failed: %s", bckt.name, err)
+			}
+			actions = append(actions, fmt.Sprintf("tagged bucket %s", friendlyName))
+		}
+
+		if bckt.objectLock.enabled() {
+			lock, err := b.s3client.GetObjectLockConfiguration(bckt.name)
+			if err != nil {
+				return actions, fmt.Errorf("Unable to determine Object Lock for bucket %s. %s", bckt.name, err)
+			}
+			if lock != bckt.objectLock {
+				if err := checkObjectLockChange(friendlyName, lock, bckt.objectLock); err != nil {
+					return actions, err
+				}
+
+				log.Printf("Reconcile: setting retention of bucket %s", bckt.name)
+				if err := b.s3client.PutObjectLockConfiguration(bckt.name, bckt.objectLock); err != nil {
+					return actions, fmt.Errorf("Setting the Object Lock retention of bucket %s failed with error: %s", bckt.name, err)
+				}
+				actions = append(actions, fmt.Sprintf("set retention of bucket %s", friendlyName))
+			}
+		}
+
+		current, err := b.getBucketConfig(bckt.name)
+		if err != nil {
+			return actions, err
+		}
+		current.encryptionRequired = bckt.encryptionRequired //enforced by the group policy fixed above
+		if bucketConfigChanged(current, bckt) {
+			log.Printf("Reconcile: configuring bucket %s", bckt.name)
+			if err := b.configureBucket(current, bckt); err != nil {
+				return actions, fmt.Errorf("Configuring bucket %s failed with error: %s", bckt.name, err)
+			}
+			actions = append(actions, fmt.Sprintf("configured bucket %s", friendlyName))
+		}
+
+		//versioning is suspended after the configuration, StorageGRID refuses while the bucket is still mirrored
+		if !bckt.versioning && !bckt.suspended {
+			continue
+		}
+
+		versioning, err := b.s3client.GetBucketVersioning(bckt.name)
+		if err != nil {
+			return actions, fmt.Errorf("Unable to determine versioning for bucket %s. %s", bckt.name, err)
+		}
+
+		if bckt.versioning && versioning != s3.BucketVersioningStatusEnabled {
+			log.Printf("Reconcile: enabling versioning on bucket %s", bckt.name)
+			if err := b.s3client.EnableBucketVersioning(bckt.name); err != nil {
+				return actions, fmt.Errorf("Enabling versioning on %s failed: %s", bckt.name, err)
+			}
+			actions = append(actions, fmt.Sprintf("enabled versioning on bucket %s", friendlyName))
+		}
+
+		if bckt.suspended && versioning == s3.BucketVersioningStatusEnabled {
+			log.Printf("Reconcile: suspending versioning on bucket %s", bckt.name)
+			if err := b.s3client.SuspendBucketVersioning(bckt.name); err != nil {
+				return actions, fmt.Errorf("Suspending versioning on %s failed: %s", bckt.name, err)
+			}
+			actions = append(actions, fmt.Sprintf("suspended versioning on bucket %s", friendlyName))
+		}
+	}
+
+	return actions, nil
+}
+
+// Compares a group policy from storageGrid with a generated one, ignoring formatting
+func equalPolicies(current json.RawMessage, policy string) bool {
+	var a, b interface{}
+
+	if err := json.Unmarshal(current, &a); err != nil {
+		return false
+	}
+
+	if err := json.Unmarshal([]byte(policy), &b); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Reconciles a single instance (?instance=<instance id>) or all recorded instances
+func (a adminAPI) ReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if a.b.state == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "No state store configured")
+		return
+	}
+
+	var instances []instanceRecord
+	if instanceID := r.URL.Query().Get("instance"); instanceID != "" {
+		rec, err := a.b.state.GetInstance(strings.ReplaceAll(instanceID, "-", ""))
+		if err != nil {
+			if err == errKeyNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error retrieving instance: %s", err)
+			return
+		}
+		instances = append(instances, rec)
+	} else {
+		recs, err := a.b.state.ListInstances()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error listing instances: %s", err)
+			return
+		}
+		instances = recs
+	}
+
+	results := []reconcileResult{}
+	for _, rec := range instances {
+		//the record of an instance with an unfinished operation isn't its final state yet, the operation (or its recovery) takes care of it
+		if a.b.operations.Unfinished(rec.InstanceID) {
+			results = append(results, reconcileResult{
+				InstanceID: rec.InstanceID,
+				Actions:    []string{},
+				Error:      "skipped, an operation is in progress",
+			})
+			continue
+		}
+
+		actions, err := a.b.reconcileInstance(rec, nil)
+
+		result := reconcileResult{
+			InstanceID: rec.InstanceID,
+			Actions:    actions,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
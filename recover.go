@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Takes over unfinished operations whose lease expired because the broker instance running them died or was restarted. Runs until the process ends.
+// Must only run in the first broker instance, see firstBrokerInstance.
+// Finished operations older than OPERATION_RETENTION are pruned from the journal once per operationPruneInterval.
+func (b *broker) RecoverOperations() {
+	var pruned time.Time
+	for {
+		b.recoverOperations()
+		if b.env.OperationRetention > 0 && time.Since(pruned) > operationPruneInterval {
+			b.pruneOperations()
+			pruned = time.Now()
+		}
+		time.Sleep(operationLease)
+	}
+}
+
+const operationPruneInterval = time.Hour
+
+func (b *broker) pruneOperations() {
+	pruned, err := b.state.PruneOperations(time.Now().Add(-b.env.OperationRetention))
+	if err != nil {
+		log.Printf("Error pruning operations: %s", err)
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d finished operations from the journal", pruned)
+	}
+}
+
+func (b *broker) recoverOperations() {
+	unfinished, err := b.state.ListUnfinishedOperations()
+	if err != nil {
+		log.Printf("Error listing unfinished operations: %s", err)
+		return
+	}
+
+	for _, rec := range unfinished {
+		if time.Now().Before(rec.LeaseExpires) || b.operations.InProgress(rec.InstanceID) {
+			continue
+		}
+
+		op := b.operations.Resume(rec)
+		log.Printf("Taking over %s operation %s of instance %s from %s", rec.Type, rec.ID, rec.InstanceID, rec.Owner)
+		go b.resumeOperation(op)
+	}
+}
+
+// Provisions and updates are resumed by bringing the instance to its journaled target state, a provision that can't be completed is compensated.
+// Deprovisions are resumed by deleting what is left of the instance.
+func (b *broker) resumeOperation(op *operation) error {
+	if op.Target == nil {
+		//the broker died before journaling anything that could have changed storageGrid
+		err := fmt.Errorf("%s was interrupted before it started", op.Type)
+		op.Fail(err)
+		return err
+	}
+
+	switch op.Type {
+	case operationProvision:
+		return b.resumeProvision(op)
+	case operationUpdate:
+		return b.resumeUpdate(op)
+	case operationDeprovision:
+		return b.resumeDeprovision(op)
+	}
+
+	err := fmt.Errorf("Unknown operation type %s", op.Type)
+	op.Fail(err)
+	return err
+}
+
+func (b *broker) resumeProvision(op *operation) error {
+	target := *op.Target
+	buckets := recordsToBuckets(target.Buckets)
+
+	if _, err := b.reconcileInstance(target, op); err != nil {
+		//only what this provision journaled as created is removed, anything else in the target may already hold data
+		s := newSaga(op)
+		for _, res := range op.JournaledResources() {
+			switch res.Kind {
+			case "group":
+				s.Adopt(res.Kind, res.Name, b.compensateGroupByName(res.Name))
+			case "bucket":
+				s.Adopt(res.Kind, res.Name, b.compensateBucket(res.Name))
+			}
+		}
+
+		return b.abort(s, fmt.Errorf("Resuming provision failed: %s", err))
+	}
+
+	if err := b.recordInstance(target, buckets); err != nil {
+		op.Fail(err)
+		return err
+	}
+
+	for friendlyName := range buckets {
+		op.SetBucketStatus(friendlyName, "created")
+	}
+
+	op.Succeed()
+	return nil
+}
+
+func (b *broker) resumeUpdate(op *operation) error {
+	target := *op.Target
+	buckets := recordsToBuckets(target.Buckets)
+
+	//buckets that can't be deleted stay part of the instance
+	var errs []error
+	if len(op.Delete) > 0 {
+		deleteList := recordsToBuckets(op.Delete)
+		deletedBuckets, delErrs := b.deleteBuckets(op, deleteList)
+		for friendlyName, bckt := range deleteList {
+			if _, ok := deletedBuckets[friendlyName]; !ok {
+				buckets[friendlyName] = bckt
+			}
+		}
+		errs = append(errs, delErrs...)
+	}
+
+	target.Buckets = bucketsToRecords(buckets)
+	if _, err := b.reconcileInstance(target, op); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := b.recordInstance(target, buckets); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		err := combineBucketErrors("Errors while resuming update", errs)
+		op.Fail(err)
+		return err
+	}
+
+	op.Succeed()
+	return nil
+}
+
+func (b *broker) resumeDeprovision(op *operation) error {
+	target := *op.Target
+
+	grp, err := b.sgClient.GetGroupByName(target.GroupName)
+	if err != nil {
+		if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+			err = fmt.Errorf("Error getting group from storageGrid: %s", err)
+			op.Fail(err)
+			return err
+		}
+
+		//the group is deleted after the buckets, only the access groups and the record can be left
+		if err := b.deleteAccessGroups(target.GroupName); err != nil {
+			op.Fail(err)
+			return err
+		}
+		if err := b.forgetInstance(target.GroupName); err != nil {
+			op.Fail(err)
+			return err
+		}
+
+		op.Succeed()
+		return nil
+	}
+
+	return b.deleteInstance(op, target.InstanceID, grp, recordsToBuckets(target.Buckets))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+func newRecoverTestBroker(t *testing.T) (*broker, *fakeStorageGrid) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	fake, sgClient := newFakeStorageGrid(t)
+	return &broker{
+		sgClient:   sgClient,
+		operations: newOperationTracker(state),
+		state:      state,
+	}, fake
+}
+
+// Waits for the resumed operation to finish
+func waitForOperation(t *testing.T, state *stateStore, instanceID string) operationRecord {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec, err := state.GetOperation(instanceID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.State != domain.InProgress {
+			return rec
+		}
+	}
+
+	t.Fatalf("the operation of instance %s didn't finish", instanceID)
+	return operationRecord{}
+}
+
+func TestRecoverOperationsTakesOverExpiredLeases(t *testing.T) {
+	b, fake := newRecoverTestBroker(t)
+
+	//the broker instance provisioning "expired" died after journaling the target, the one provisioning "leased" is still alive
+	now := time.Now()
+	operations := []operationRecord{
+		{
+			ID: "expired", InstanceID: "inst-a", Type: operationProvision, State: domain.InProgress,
+			Target: &instanceRecord{InstanceID: "inst-a", GroupName: "insta"},
+			Owner:  "dead", LeaseExpires: now.Add(-time.Minute), Started: now.Add(-time.Hour),
+		},
+		{
+			ID: "leased", InstanceID: "inst-b", Type: operationProvision, State: domain.InProgress,
+			Target: &instanceRecord{InstanceID: "inst-b", GroupName: "instb"},
+			Owner:  "alive", LeaseExpires: now.Add(time.Minute), Started: now,
+		},
+	}
+	for _, rec := range operations {
+		if err := b.state.PutOperation(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.recoverOperations()
+
+	taken := waitForOperation(t, b.state, "inst-a")
+	if taken.State != domain.Succeeded || taken.Owner != b.operations.owner {
+		t.Errorf("got %s operation owned by %s, want it completed by this broker instance", taken.State, taken.Owner)
+	}
+	if !strings.Contains(strings.Join(taken.Steps, ","), "taken over by "+b.operations.owner) {
+		t.Errorf("the takeover isn't in the steps %v", taken.Steps)
+	}
+	if _, ok := fake.Group("insta"); !ok {
+		t.Error("the group of the taken over provision wasn't created")
+	}
+	if _, err := b.state.GetInstance("insta"); err != nil {
+		t.Errorf("the taken over instance wasn't recorded: %s", err)
+	}
+
+	leased, err := b.state.GetOperation("inst-b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased.State != domain.InProgress || leased.Owner != "alive" {
+		t.Errorf("an operation with a valid lease was taken over: %+v", leased)
+	}
+	if _, ok := fake.Group("instb"); ok {
+		t.Error("an operation with a valid lease was resumed")
+	}
+}
+
+func TestResumeProvisionCompensatesJournaledResources(t *testing.T) {
+	b, fake := newRecoverTestBroker(t)
+
+	//the provision created the group and died. The read-only group and the bucket in the target weren't created by it.
+	grp := fake.AddGroup("insta", "{}")
+	fake.AddGroup(accessGroupName("insta", accessReadOnly), "{}")
+	fake.Fail("PUT", "org/groups/"+grp.ID)
+
+	//the s3 client isn't set up, compensating the bucket would fail the test
+	target := instanceRecord{
+		InstanceID: "inst-a",
+		GroupName:  "insta",
+		Buckets:    bucketsToRecords(map[string]Bucket{"a": {name: "a-1"}}),
+	}
+	op := b.operations.Resume(operationRecord{
+		ID: "provision", InstanceID: "inst-a", Type: operationProvision, State: domain.InProgress,
+		Target:    &target,
+		Resources: []journalResource{{Kind: "group", Name: "insta"}},
+		Started:   time.Now(),
+	})
+
+	err := b.resumeOperation(op)
+	if err == nil || !strings.Contains(err.Error(), "Everything created so far has been rolled back") {
+		t.Errorf("got error %v, want the provision rolled back", err)
+	}
+
+	if deleted := fake.Deleted(); !reflect.DeepEqual(deleted, []string{"group insta"}) {
+		t.Errorf("deleted %v, want only the journaled group", deleted)
+	}
+	if _, ok := fake.Group(accessGroupName("insta", accessReadOnly)); !ok {
+		t.Error("a group that wasn't journaled was deleted")
+	}
+
+	rec, err := b.state.GetOperation("inst-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.State != domain.Failed {
+		t.Errorf("got operation state %s, want %s", rec.State, domain.Failed)
+	}
+	if orphans, _ := b.state.ListOrphans(); len(orphans) > 0 {
+		t.Errorf("got orphans %v", orphans)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// replicationEndpoint is an external S3 store buckets can be mirrored to with CloudMirror. Endpoints are defined by the operator,
+// the broker creates a destination bucket with the name of the source bucket and a StorageGRID endpoint for every replicated bucket.
+type replicationEndpoint struct {
+	URI             string `json:"uri"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	URNPrefix       string `json:"urn_prefix"` //the destination bucket name is appended, default arn:aws:s3:::
+	PathStyle       bool   `json:"path_style"`
+	InsecureTLS     bool   `json:"insecure_tls"`
+}
+
+// replicationEndpoints are read from REPLICATION_ENDPOINTS as a JSON object with the endpoint names as keys
+type replicationEndpoints map[string]replicationEndpoint
+
+func (e *replicationEndpoints) Decode(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(value), e)
+}
+
+func (ep replicationEndpoint) urn(bucketName string) string {
+	prefix := ep.URNPrefix
+	if prefix == "" {
+		prefix = "arn:aws:s3:::"
+	}
+
+	return prefix + bucketName
+}
+
+// The broker names the endpoints it creates after the bucket and the replication endpoint, e.g. "mybucket-0123abcd... (dr)"
+func replicationDisplayName(bucketName, endpoint string) string {
+	return fmt.Sprintf("%s (%s)", bucketName, endpoint)
+}
+
+// Returns the StorageGRID endpoints the broker created to mirror a bucket: those with the exact URN or display name the broker uses for one of
+// the configured replication endpoints. Other endpoints of the tenant are never touched.
+func (b *broker) bucketEndpoints(bucketName string) ([]sgEndpoint, error) {
+	endpoints, err := b.sgClient.ListEndpoints()
+	if err != nil {
+		return nil, fmt.Errorf("Listing endpoints failed: %s", err)
+	}
+
+	var owned []sgEndpoint
+	for _, endpoint := range endpoints {
+		for name, ep := range b.env.ReplicationEndpoints {
+			if endpoint.EndpointURN == ep.urn(bucketName) || endpoint.DisplayName == replicationDisplayName(bucketName, name) {
+				owned = append(owned, endpoint)
+				break
+			}
+		}
+	}
+
+	return owned, nil
+}
+
+func (b *broker) validateReplicationParam(bucketName, endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	if _, ok := b.env.ReplicationEndpoints[endpoint]; !ok {
+		err := fmt.Errorf("Unknown replication endpoint \"%s\" for bucket %s", endpoint, bucketName)
+		return apiresponses.NewFailureResponse(err, http.StatusBadRequest, "invalid-replication")
+	}
+
+	return nil
+}
+
+// Mirrors a bucket to its replication endpoint: creates the destination bucket and the StorageGRID endpoint when they don't exist yet and
+// sets the replication configuration. Replication requires versioning so it's enabled first.
+func (b *broker) enableReplication(bckt Bucket) error {
+	ep := b.env.ReplicationEndpoints[bckt.replication]
+	urn := ep.urn(bckt.name)
+
+	if err := b.s3client.EnableBucketVersioning(bckt.name); err != nil {
+		return fmt.Errorf("Enabling versioning failed: %s", err)
+	}
+
+	if err := createDestinationBucket(ep, bckt.name); err != nil {
+		return fmt.Errorf("Creating destination bucket on %s failed: %s", bckt.replication, err)
+	}
+
+	endpoints, err := b.bucketEndpoints(bckt.name)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, endpoint := range endpoints {
+		//the bucket was mirrored to another store before
+		if endpoint.EndpointURN != urn || endpoint.EndpointURI != ep.URI {
+			if err := b.sgClient.DeleteEndpoint(endpoint.ID); err != nil {
+				return fmt.Errorf("Deleting endpoint %s failed: %s", endpoint.DisplayName, err)
+			}
+			continue
+		}
+
+		found = true
+	}
+
+	if !found {
+		log.Printf("Creating endpoint for replication of bucket %s to %s", bckt.name, bckt.replication)
+		_, err := b.sgClient.CreateEndpoint(sgEndpoint{
+			DisplayName: replicationDisplayName(bckt.name, bckt.replication),
+			EndpointURI: ep.URI,
+			EndpointURN: urn,
+			Auth: sgEndpointAuth{
+				Type: "s3",
+				S3: &sgEndpointS3Auth{
+					AccessKeyID:     ep.AccessKeyID,
+					SecretAccessKey: ep.SecretAccessKey,
+				},
+			},
+			InsecureTLS: ep.InsecureTLS,
+		})
+		if err != nil {
+			return fmt.Errorf("Creating endpoint failed: %s", err)
+		}
+	}
+
+	if err := b.s3client.PutBucketReplication(bckt.name, urn); err != nil {
+		return fmt.Errorf("Setting replication configuration failed: %s", err)
+	}
+
+	return nil
+}
+
+// Stops mirroring a bucket. The destination bucket and its objects are kept.
+func (b *broker) disableReplication(bucketName string) error {
+	if err := b.s3client.DeleteBucketReplication(bucketName); err != nil {
+		return fmt.Errorf("Deleting replication configuration failed: %s", err)
+	}
+
+	return b.deleteReplicationEndpoints(bucketName)
+}
+
+// Deletes the StorageGRID endpoints the broker created for a bucket
+func (b *broker) deleteReplicationEndpoints(bucketName string) error {
+	endpoints, err := b.bucketEndpoints(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		log.Printf("Deleting endpoint %s", endpoint.DisplayName)
+		if err := b.sgClient.DeleteEndpoint(endpoint.ID); err != nil {
+			if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+				return fmt.Errorf("Deleting endpoint %s failed: %s", endpoint.DisplayName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Deletes the endpoints of a deleted bucket. The bucket is gone already so a failure doesn't fail the operation, the endpoints are left to the janitor instead.
+func (b *broker) removeReplicationEndpoints(op *operation, bucketName string) {
+	err := b.deleteReplicationEndpoints(bucketName)
+	if err == nil {
+		return
+	}
+
+	log.Printf("Removing endpoints of bucket %s failed: %s", bucketName, err)
+	if b.state != nil {
+		orphan := orphanRecord{
+			Kind:       "endpoint",
+			Name:       bucketName,
+			InstanceID: op.InstanceID,
+			Operation:  op.OperationData(),
+			Error:      err.Error(),
+			RecordedAt: time.Now(),
+		}
+		if perr := b.state.PutOrphan(orphan); perr != nil {
+			log.Printf("Error recording orphaned endpoint of bucket %s: %s", bucketName, perr)
+		}
+	}
+}
+
+// Returns the name of the replication endpoint a bucket is mirrored to, or an empty string when it isn't mirrored
+func (b *broker) getBucketReplication(bucketName string) (string, error) {
+	urn, err := b.s3client.GetBucketReplication(bucketName)
+	if err != nil || urn == "" {
+		return "", err
+	}
+
+	endpoints, err := b.bucketEndpoints(bucketName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, endpoint := range endpoints {
+		if endpoint.EndpointURN != urn {
+			continue
+		}
+
+		for name, ep := range b.env.ReplicationEndpoints {
+			if ep.URI == endpoint.EndpointURI && ep.urn(bucketName) == urn {
+				return name, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+func createDestinationBucket(ep replicationEndpoint, bucketName string) error {
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: ep.InsecureTLS},
+		},
+		Timeout: 15 * time.Second,
+	}
+
+	region := ep.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		HTTPClient:       &httpClient,
+		Credentials:      credentials.NewStaticCredentials(ep.AccessKeyID, ep.SecretAccessKey, ""),
+		Endpoint:         aws.String(ep.URI),
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(ep.PathStyle),
+	})
+	if err != nil {
+		return err
+	}
+
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(bucketName),
+	}
+	//us-east-1 is the only region that must not be sent as location constraint
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+
+	_, err = s3.New(sess).CreateBucket(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain/apiresponses"
+)
+
+// brokerapi v6 predates binding rotation (OSB 2.17). The rotation middleware fills the gaps: it hands the predecessor binding ID to Bind through
+// the request context and adds binding_rotatable to the catalog and the binding metadata (expires_at, renew_before) to binding responses.
+type contextKey string
+
+const (
+	predecessorBindingKey contextKey = "predecessor_binding_id"
+	bindingMetadataKey    contextKey = "binding_metadata"
+)
+
+var bindingPath = regexp.MustCompile(`^/v2/service_instances/[^/]+/service_bindings/[^/]+$`)
+
+type bindingMetadata struct {
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	RenewBefore string `json:"renew_before,omitempty"`
+}
+
+// Returns the time the keys of a new binding expire. App bindings and service keys have separate lifetimes. Returns a zero time when the keys don't expire.
+func (b *broker) bindingExpiry(appGUID string) time.Time {
+	lifetime := b.env.BindingLifetime
+	if appGUID == "" {
+		lifetime = b.env.ServiceKeyLifetime
+	}
+
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(lifetime)
+}
+
+// Returns the metadata for a binding expiring at expiresAt, or nil when the binding doesn't expire
+func (b *broker) newBindingMetadata(expiresAt time.Time) *bindingMetadata {
+	if expiresAt.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	renewBefore := expiresAt.Add(-b.env.BindingRenewBefore)
+	if renewBefore.Before(now) {
+		renewBefore = now
+	}
+
+	return &bindingMetadata{
+		ExpiresAt:   expiresAt.UTC().Format(time.RFC3339),
+		RenewBefore: renewBefore.UTC().Format(time.RFC3339),
+	}
+}
+
+func predecessorBindingID(ctx context.Context) string {
+	id, _ := ctx.Value(predecessorBindingKey).(string)
+	return id
+}
+
+// Hands the metadata of a binding to the rotation middleware so it ends up in the response
+func setBindingMetadata(ctx context.Context, metadata *bindingMetadata) {
+	if holder, ok := ctx.Value(bindingMetadataKey).(*bindingMetadata); ok && metadata != nil {
+		*holder = *metadata
+	}
+}
+
+func rotationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/catalog":
+			rewriteResponse(w, r, next, func(body map[string]interface{}) {
+				services, _ := body["services"].([]interface{})
+				for _, service := range services {
+					if s, ok := service.(map[string]interface{}); ok {
+						s["binding_rotatable"] = true
+					}
+				}
+			})
+
+		case (r.Method == http.MethodPut || r.Method == http.MethodGet) && bindingPath.MatchString(r.URL.Path):
+			ctx := r.Context()
+			if r.Method == http.MethodPut {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+				var details struct {
+					PredecessorBindingID string `json:"predecessor_binding_id"`
+				}
+				//invalid bodies are left to brokerapi to reject
+				if json.Unmarshal(body, &details) == nil && details.PredecessorBindingID != "" {
+					ctx = context.WithValue(ctx, predecessorBindingKey, details.PredecessorBindingID)
+				}
+			}
+
+			metadata := &bindingMetadata{}
+			ctx = context.WithValue(ctx, bindingMetadataKey, metadata)
+
+			rewriteResponse(w, r.WithContext(ctx), next, func(body map[string]interface{}) {
+				if *metadata != (bindingMetadata{}) {
+					body["metadata"] = metadata
+				}
+			})
+
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Serves the request with next and lets rewrite change successful JSON responses before they are sent
+func rewriteResponse(w http.ResponseWriter, r *http.Request, next http.Handler, rewrite func(map[string]interface{})) {
+	buf := &bufferedResponseWriter{header: w.Header()}
+	next.ServeHTTP(buf, r)
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+
+	body := buf.body.Bytes()
+	if buf.status >= 200 && buf.status < 300 {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal(body, &parsed); err == nil {
+			rewrite(parsed)
+			if rewritten, err := json.Marshal(parsed); err == nil {
+				body = rewritten
+			}
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(buf.status)
+	w.Write(body)
+}
+
+// Returns the parameters of the binding being rotated so the new binding gets the same access. The predecessor has to belong to the same instance.
+func (b *broker) predecessorParameters(instanceID, predecessorID string, requested json.RawMessage) (json.RawMessage, error) {
+	if b.state != nil {
+		rec, err := b.state.GetBinding(predecessorID)
+		if err == nil {
+			if rec.InstanceID != instanceID {
+				return nil, errPredecessorNotFound(predecessorID)
+			}
+			return rec.Parameters, nil
+		}
+		if err != errKeyNotFound {
+			return nil, fmt.Errorf("Error retrieving binding %s from state store: %s", predecessorID, err)
+		}
+	}
+
+	if b.bindings != nil {
+		binding, err := b.bindings.Get(predecessorID)
+		if err == nil {
+			if binding.InstanceID != instanceID {
+				return nil, errPredecessorNotFound(predecessorID)
+			}
+			return binding.Parameters, nil
+		}
+		if err != errKeyNotFound {
+			return nil, fmt.Errorf("Error retrieving binding %s from binding store: %s", predecessorID, err)
+		}
+	}
+
+	//without a record of the predecessor the requested parameters are used, as long as its user still exists
+	if _, err := b.sgClient.GetUserByName(strings.ReplaceAll(predecessorID, "-", "")); err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			return nil, errPredecessorNotFound(predecessorID)
+		}
+		return nil, fmt.Errorf("Error retrieving user for binding %s: %s", predecessorID, err)
+	}
+
+	return requested, nil
+}
+
+func errPredecessorNotFound(predecessorID string) error {
+	return apiresponses.NewFailureResponse(fmt.Errorf("Predecessor binding %s does not exist in this service instance", predecessorID), http.StatusBadRequest, "predecessor-not-found")
+}
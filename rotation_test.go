@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBindRotatesPredecessor(t *testing.T) {
+	services, err := CatalogLoad("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	fake, sgClient := newFakeStorageGrid(t)
+	b := &broker{
+		services:   services,
+		sgClient:   sgClient,
+		s3client:   &s3client{Endpoint: "s3.example.com"},
+		operations: newOperationTracker(state),
+		state:      state,
+	}
+
+	//an instance with two buckets and a read-only binding restricted to one of them
+	const (
+		instanceID    = "inst-1"
+		predecessorID = "old-1"
+		bindingID     = "new-1"
+	)
+	predecessorParams := json.RawMessage(`{"access":"read-only","buckets":["a"]}`)
+
+	fake.AddGroup("inst1", "{}")
+	fake.AddUser("old1", "AK-old")
+	buckets := map[string]Bucket{"a": {name: "a-1"}, "b": {name: "b-2"}}
+	if err := b.recordInstance(instanceRecord{InstanceID: instanceID, GroupName: "inst1"}, buckets); err != nil {
+		t.Fatal(err)
+	}
+	err = state.PutBinding(bindingRecord{BindingID: predecessorID, InstanceID: instanceID, UserName: "old1", Parameters: predecessorParams})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the platform rotates the binding without repeating its parameters
+	handler := rotationMiddleware(brokerapi.New(b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "password"}))
+	body := `{"service_id": "` + services[0].ID + `", "plan_id": "` + services[0].Plans[0].ID + `", "predecessor_binding_id": "` + predecessorID + `", "parameters": {"access": "read-write"}}`
+	req := httptest.NewRequest(http.MethodPut, "/v2/service_instances/"+instanceID+"/service_bindings/"+bindingID, strings.NewReader(body))
+	req.SetBasicAuth("user", "password")
+	req.Header.Set("X-Broker-API-Version", "2.14")
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response struct {
+		Credentials Credentials `json:"credentials"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	//the new binding has the access of its predecessor
+	creds := response.Credentials
+	if creds.Access != accessReadOnly || len(creds.Buckets) != 1 || creds.Buckets[0].Name != "a" {
+		t.Errorf("got %s access to %+v, want read-only access to bucket a only", creds.Access, creds.Buckets)
+	}
+
+	recorded, err := state.GetBinding(bindingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded.PredecessorBindingID != predecessorID || !sameBindParameters(recorded.Parameters, predecessorParams) {
+		t.Errorf("recorded binding %+v, want the parameters of %s", recorded, predecessorID)
+	}
+
+	//with its own user and keys, in a group of its own
+	user, keys, ok := fake.User("new1")
+	if !ok {
+		t.Fatal("no user was created for the new binding")
+	}
+	if len(keys) != 1 || keys[0].AccessKey != creds.AccessKeyID || creds.AccessKeyID == "AK-old" {
+		t.Errorf("got keys %+v and access key %s, want one new key", keys, creds.AccessKeyID)
+	}
+	if grp, ok := fake.Group(bindingGroupName("new1")); !ok || len(user.MemberOf) != 1 || user.MemberOf[0] != grp.ID {
+		t.Errorf("user %+v isn't in the group of the binding", user)
+	}
+
+	//the predecessor keeps working until it is unbound
+	if _, keys, ok := fake.User("old1"); !ok || len(keys) != 1 || keys[0].AccessKey != "AK-old" {
+		t.Errorf("the predecessor changed: %+v", keys)
+	}
+	if deleted := fake.Deleted(); len(deleted) > 0 {
+		t.Errorf("deleted %v while rotating", deleted)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -80,7 +83,7 @@ func (c *s3client) login() error {
 	return nil
 }
 
-func (c *s3client) CreateBucket(bucketName, region string) (*s3.CreateBucketOutput, error) {
+func (c *s3client) CreateBucket(bucketName, region string, objectLock bool) (*s3.CreateBucketOutput, error) {
 	err := c.login()
 	if err != nil {
 		return nil, err
@@ -91,12 +94,18 @@ func (c *s3client) CreateBucket(bucketName, region string) (*s3.CreateBucketOutp
 		useRegion = c.Region
 	}
 
-	cbOutput, err := c.Client.CreateBucket(&s3.CreateBucketInput{
+	input := &s3.CreateBucketInput{
 		Bucket: aws.String(bucketName),
 		CreateBucketConfiguration: &s3.CreateBucketConfiguration{
 			LocationConstraint: aws.String(useRegion),
 		},
-	})
+	}
+	//only send the Object Lock header when it's requested, so other buckets are created with the same request as before
+	if objectLock {
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+
+	cbOutput, err := c.Client.CreateBucket(input)
 
 	if err != nil {
 		return nil, err
@@ -140,30 +149,445 @@ func (c *s3client) GetBucketRegion(bucketName string) (string, error) {
 	return *res.LocationConstraint, nil
 }
 
-func (c *s3client) GetBucketVersioning(bucketName string) (bool, error) {
+// Returns the versioning state of a bucket: s3.BucketVersioningStatusEnabled, s3.BucketVersioningStatusSuspended
+// or an empty string when versioning has never been enabled
+func (c *s3client) GetBucketVersioning(bucketName string) (string, error) {
+	err := c.login()
+	if err != nil {
+		return "", err
+	}
+
 	res, err := c.Client.GetBucketVersioning(&s3.GetBucketVersioningInput{
 		Bucket: aws.String(bucketName),
 	})
 
 	if err != nil {
-		return false, err
-	}
-
-	if res.Status == nil {
-		return false, nil
+		return "", err
 	}
 
-	return true, nil
+	return aws.StringValue(res.Status), nil
 }
 
 func (c *s3client) EnableBucketVersioning(bucketName string) error {
-	_, err := c.Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+	return c.putBucketVersioning(bucketName, s3.BucketVersioningStatusEnabled)
+}
+
+// Stops creating new versions. Existing versions are kept.
+func (c *s3client) SuspendBucketVersioning(bucketName string) error {
+	return c.putBucketVersioning(bucketName, s3.BucketVersioningStatusSuspended)
+}
+
+func (c *s3client) putBucketVersioning(bucketName, status string) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
 		Bucket: aws.String(bucketName),
 		VersioningConfiguration: &s3.VersioningConfiguration{
 			MFADelete: aws.String(s3.MFADeleteDisabled),
-			Status:    aws.String(s3.BucketVersioningStatusEnabled),
+			Status:    aws.String(status),
+		},
+	})
+
+	return err
+}
+
+func (c *s3client) PutBucketTagging(bucketName string, tags map[string]string) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	tagSet := []*s3.Tag{}
+	for key, value := range tags {
+		tagSet = append(tagSet, &s3.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+
+	_, err = c.Client.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket:  aws.String(bucketName),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+
+	return err
+}
+
+// Returns the tags of a bucket, an empty map when it has none
+func (c *s3client) GetBucketTagging(bucketName string) (map[string]string, error) {
+	err := c.login()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	res, err := c.Client.GetBucketTagging(&s3.GetBucketTaggingInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchTagSet" {
+			return tags, nil
+		}
+		return nil, err
+	}
+
+	for _, tag := range res.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+func (c *s3client) PutObjectLockConfiguration(bucketName string, lock objectLockConfig) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+		Bucket: aws.String(bucketName),
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule: &s3.ObjectLockRule{
+				DefaultRetention: &s3.DefaultRetention{
+					Mode: aws.String(lock.mode),
+					Days: aws.Int64(lock.days),
+				},
+			},
+		},
+	})
+
+	return err
+}
+
+// Returns the default retention of a bucket, the zero value when Object Lock is not enabled
+func (c *s3client) GetObjectLockConfiguration(bucketName string) (objectLockConfig, error) {
+	err := c.login()
+	if err != nil {
+		return objectLockConfig{}, err
+	}
+
+	res, err := c.Client.GetObjectLockConfiguration(&s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ObjectLockConfigurationNotFoundError" {
+			return objectLockConfig{}, nil
+		}
+		return objectLockConfig{}, err
+	}
+
+	conf := res.ObjectLockConfiguration
+	if conf == nil || aws.StringValue(conf.ObjectLockEnabled) != s3.ObjectLockEnabledEnabled {
+		return objectLockConfig{}, nil
+	}
+
+	lock := objectLockWithoutRetention
+	if conf.Rule != nil && conf.Rule.DefaultRetention != nil {
+		retention := conf.Rule.DefaultRetention
+		if retention.Mode != nil {
+			lock.mode = *retention.Mode
+		}
+		lock.days = aws.Int64Value(retention.Days) + 365*aws.Int64Value(retention.Years)
+	}
+
+	return lock, nil
+}
+
+// Returns true when a bucket holds any object versions or delete markers
+func (c *s3client) BucketHasObjectVersions(bucketName string) (bool, error) {
+	err := c.login()
+	if err != nil {
+		return false, err
+	}
+
+	res, err := c.Client.ListObjectVersions(&s3.ListObjectVersionsInput{
+		Bucket:  aws.String(bucketName),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(res.Versions) > 0 || len(res.DeleteMarkers) > 0, nil
+}
+
+// Replaces the lifecycle rules of a bucket. Without rules the lifecycle configuration is deleted.
+func (c *s3client) PutBucketLifecycle(bucketName string, rules []ProvisionParamsLifecycleRule) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	if len(rules) == 0 {
+		_, err = c.Client.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(bucketName),
+		})
+		return err
+	}
+
+	_, err = c.Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: lifecycleToS3(rules),
 		},
 	})
 
 	return err
 }
+
+func (c *s3client) GetBucketLifecycle(bucketName string) ([]ProvisionParamsLifecycleRule, error) {
+	err := c.login()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchLifecycleConfiguration" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return lifecycleFromS3(res.Rules), nil
+}
+
+// Replaces the CORS rules of a bucket. Without rules the CORS configuration is deleted.
+func (c *s3client) PutBucketCors(bucketName string, rules []ProvisionParamsCORSRule) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	if len(rules) == 0 {
+		_, err = c.Client.DeleteBucketCors(&s3.DeleteBucketCorsInput{
+			Bucket: aws.String(bucketName),
+		})
+		return err
+	}
+
+	_, err = c.Client.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket: aws.String(bucketName),
+		CORSConfiguration: &s3.CORSConfiguration{
+			CORSRules: corsToS3(rules),
+		},
+	})
+
+	return err
+}
+
+func (c *s3client) GetBucketCors(bucketName string) ([]ProvisionParamsCORSRule, error) {
+	err := c.login()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Client.GetBucketCors(&s3.GetBucketCorsInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchCORSConfiguration" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return corsFromS3(res.CORSRules), nil
+}
+
+// Enables default encryption with SSE-S3 on a bucket, or removes the default encryption
+func (c *s3client) PutBucketEncryption(bucketName string, enabled bool) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	if !enabled {
+		_, err = c.Client.DeleteBucketEncryption(&s3.DeleteBucketEncryptionInput{
+			Bucket: aws.String(bucketName),
+		})
+		return err
+	}
+
+	_, err = c.Client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bucketName),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+					SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+				},
+			}},
+		},
+	})
+
+	return err
+}
+
+// Returns true when a bucket has default encryption
+func (c *s3client) GetBucketEncryption(bucketName string) (bool, error) {
+	err := c.login()
+	if err != nil {
+		return false, err
+	}
+
+	res, err := c.Client.GetBucketEncryption(&s3.GetBucketEncryptionInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ServerSideEncryptionConfigurationNotFoundError" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return res.ServerSideEncryptionConfiguration != nil && len(res.ServerSideEncryptionConfiguration.Rules) > 0, nil
+}
+
+// Mirrors all objects of a bucket to the endpoint with the given URN
+func (c *s3client) PutBucketReplication(bucketName, destinationURN string) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.PutBucketReplication(&s3.PutBucketReplicationInput{
+		Bucket: aws.String(bucketName),
+		ReplicationConfiguration: &s3.ReplicationConfiguration{
+			Role: aws.String(""), //StorageGRID doesn't use the role
+			Rules: []*s3.ReplicationRule{{
+				ID:     aws.String("cloudmirror"),
+				Status: aws.String(s3.ReplicationRuleStatusEnabled),
+				Prefix: aws.String(""),
+				Destination: &s3.Destination{
+					Bucket: aws.String(destinationURN),
+				},
+			}},
+		},
+	})
+
+	return err
+}
+
+func (c *s3client) DeleteBucketReplication(bucketName string) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.DeleteBucketReplication(&s3.DeleteBucketReplicationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ReplicationConfigurationNotFoundError" {
+		return nil
+	}
+
+	return err
+}
+
+// Returns the URN of the destination of a bucket, or an empty string when the bucket isn't replicated
+func (c *s3client) GetBucketReplication(bucketName string) (string, error) {
+	err := c.login()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.Client.GetBucketReplication(&s3.GetBucketReplicationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ReplicationConfigurationNotFoundError" {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if res.ReplicationConfiguration == nil {
+		return "", nil
+	}
+
+	for _, rule := range res.ReplicationConfiguration.Rules {
+		if rule.Destination != nil {
+			return aws.StringValue(rule.Destination.Bucket), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (c *s3client) PutObject(bucketName, key string, body []byte) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+
+	return err
+}
+
+func (c *s3client) GetObject(bucketName, key string) ([]byte, error) {
+	err := c.login()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (c *s3client) DeleteObject(bucketName, key string) error {
+	err := c.login()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+// Returns the keys of all objects in a bucket starting with prefix
+func (c *s3client) ListObjectKeys(bucketName, prefix string) ([]string, error) {
+	err := c.login()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	err = c.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
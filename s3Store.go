@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Store keeps key/value pairs as objects in a StorageGrid bucket. Unlike the fileStore it can be shared by all broker instances.
+type s3Store struct {
+	s3client *s3client
+	bucket   string
+}
+
+// Creates a store in bucket. The bucket is created when it doesn't exist yet.
+func NewS3Store(client *s3client, bucket string) (*s3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("A bucket name is required for the s3 store")
+	}
+
+	_, err := client.CreateBucket(bucket, "", false)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); !ok || (awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou && awsErr.Code() != s3.ErrCodeBucketAlreadyExists) {
+			return nil, fmt.Errorf("Error creating bucket %s: %s", bucket, err)
+		}
+	} else {
+		log.Printf("Created bucket %s", bucket)
+	}
+
+	return &s3Store{
+		s3client: client,
+		bucket:   bucket,
+	}, nil
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	value, err := s.s3client.GetObject(s.bucket, key)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, errKeyNotFound
+		}
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s *s3Store) Put(key string, value []byte) error {
+	return s.s3client.PutObject(s.bucket, key, value)
+}
+
+func (s *s3Store) Delete(key string) error {
+	return s.s3client.DeleteObject(s.bucket, key)
+}
+
+func (s *s3Store) Keys(prefix string) ([]string, error) {
+	keys, err := s.s3client.ListObjectKeys(s.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
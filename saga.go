@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// saga records the steps of an operation together with the compensating action that undoes each step.
+// When a later step fails the completed steps are rolled back in reverse order.
+type saga struct {
+	op    *operation
+	steps []sagaStep
+}
+
+type sagaStep struct {
+	kind       string
+	name       string
+	compensate func() error
+}
+
+// orphanRecord is a group or bucket that couldn't be rolled back. Orphans are kept in the state store until the janitor removes them.
+type orphanRecord struct {
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	InstanceID string    `json:"instance_id"`
+	Operation  string    `json:"operation"`
+	Error      string    `json:"error"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+func newSaga(op *operation) *saga {
+	return &saga{
+		op: op,
+	}
+}
+
+// Records a completed step. compensate has to undo the step and verify it has been undone.
+func (s *saga) Done(kind, name string, compensate func() error) {
+	s.steps = append(s.steps, sagaStep{
+		kind:       kind,
+		name:       name,
+		compensate: compensate,
+	})
+	s.op.AddResource(kind, name)
+}
+
+// Adds a step completed before the saga was (re)created, for example by a broker instance that died. The step is not journaled again.
+func (s *saga) Adopt(kind, name string, compensate func() error) {
+	s.steps = append(s.steps, sagaStep{
+		kind:       kind,
+		name:       name,
+		compensate: compensate,
+	})
+}
+
+// Undoes all completed steps in reverse order. Returns the steps that couldn't be undone.
+func (s *saga) Rollback() []orphanRecord {
+	var orphans []orphanRecord
+
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		step := s.steps[i]
+		log.Printf("Rolling back: deleting %s %s", step.kind, step.name)
+
+		if err := step.compensate(); err != nil {
+			log.Printf("Rolling back %s %s failed: %s", step.kind, step.name, err)
+			s.op.AddStep(fmt.Sprintf("rollback of %s %s failed", step.kind, step.name))
+			orphans = append(orphans, orphanRecord{
+				Kind:       step.kind,
+				Name:       step.name,
+				InstanceID: s.op.InstanceID,
+				Operation:  s.op.OperationData(),
+				Error:      err.Error(),
+				RecordedAt: time.Now(),
+			})
+			continue
+		}
+
+		s.op.AddStep(fmt.Sprintf("rolled back %s %s", step.kind, step.name))
+	}
+
+	return orphans
+}
+
+// Rolls back the saga after err and fails the operation. Anything that couldn't be rolled back is reported and kept for the janitor.
+func (b *broker) abort(s *saga, err error) error {
+	orphans := s.Rollback()
+	if len(orphans) == 0 {
+		err = fmt.Errorf("%s. Everything created so far has been rolled back", err)
+		s.op.Fail(err)
+		return err
+	}
+
+	var leftBehind []string
+	for _, orphan := range orphans {
+		leftBehind = append(leftBehind, fmt.Sprintf("%s %s", orphan.Kind, orphan.Name))
+		if b.state != nil {
+			if perr := b.state.PutOrphan(orphan); perr != nil {
+				log.Printf("Error recording orphaned %s %s: %s", orphan.Kind, orphan.Name, perr)
+			}
+		}
+	}
+
+	err = fmt.Errorf("%s. Rollback incomplete, left behind: %s", err, strings.Join(leftBehind, ", "))
+	s.op.Fail(err)
+	return err
+}
+
+// Deletes a group and verifies it is gone
+func (b *broker) compensateGroup(grp sgGroup) func() error {
+	return func() error {
+		if err := b.sgClient.DeleteGroup(grp.ID); err != nil {
+			if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+				return err
+			}
+		}
+
+		_, err := b.sgClient.GetGroupByName(strings.TrimPrefix(grp.UniqueName, "group/"))
+		if err == nil {
+			return fmt.Errorf("group %s still exists after deleting it", grp.DisplayName)
+		}
+		if ae, ok := err.(apiError); !ok || ae.statusCode != http.StatusNotFound {
+			return fmt.Errorf("unable to verify group %s has been deleted: %s", grp.DisplayName, err)
+		}
+
+		return nil
+	}
+}
+
+// Deletes a group by name, if it exists, and verifies it is gone
+func (b *broker) compensateGroupByName(name string) func() error {
+	return func() error {
+		grp, err := b.sgClient.GetGroupByName(name)
+		if err != nil {
+			if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+				return nil
+			}
+			return err
+		}
+
+		return b.compensateGroup(grp)()
+	}
+}
+
+// Deletes a bucket and verifies it is gone
+func (b *broker) compensateBucket(name string) func() error {
+	return func() error {
+		if _, err := b.s3client.DeleteBucket(name); err != nil {
+			if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchBucket {
+				return err
+			}
+		}
+
+		_, err := b.s3client.GetBucketRegion(name)
+		if err == nil {
+			return fmt.Errorf("bucket %s still exists after deleting it", name)
+		}
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchBucket {
+			return fmt.Errorf("unable to verify bucket %s has been deleted: %s", name, err)
+		}
+
+		return b.deleteReplicationEndpoints(name)
+	}
+}
+
+// Tries to remove all recorded orphans. Orphans that are removed are forgotten, the others are kept with the latest error.
+func (b *broker) cleanupOrphans() ([]orphanRecord, error) {
+	orphans, err := b.state.ListOrphans()
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := []orphanRecord{}
+	for _, orphan := range orphans {
+		var cerr error
+		switch orphan.Kind {
+		case "bucket":
+			cerr = b.compensateBucket(orphan.Name)()
+		case "group":
+			cerr = b.compensateGroupByName(orphan.Name)()
+		case "endpoint":
+			cerr = b.deleteReplicationEndpoints(orphan.Name)
+		default:
+			cerr = fmt.Errorf("unknown kind %s", orphan.Kind)
+		}
+
+		if cerr != nil {
+			log.Printf("Janitor: removing %s %s failed: %s", orphan.Kind, orphan.Name, cerr)
+			orphan.Error = cerr.Error()
+			if err := b.state.PutOrphan(orphan); err != nil {
+				return nil, err
+			}
+			remaining = append(remaining, orphan)
+			continue
+		}
+
+		log.Printf("Janitor: removed %s %s", orphan.Kind, orphan.Name)
+		if err := b.state.DeleteOrphan(orphan); err != nil {
+			return nil, err
+		}
+	}
+
+	return remaining, nil
+}
+
+// Lists the orphans (GET) or lets the janitor try to remove them (POST). Returns the orphans that are left.
+func (a adminAPI) OrphansHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	if a.b.state == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "No state store configured")
+		return
+	}
+
+	var (
+		orphans []orphanRecord
+		err     error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		orphans, err = a.b.state.ListOrphans()
+	case http.MethodPost:
+		orphans, err = a.b.cleanupOrphans()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error handling orphans: %s", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(orphans)
+}
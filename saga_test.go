@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+func TestAbortProvisioning(t *testing.T) {
+	tests := []struct {
+		name         string
+		failing      map[string]bool //resources whose compensation fails
+		wantOrphans  []string
+		wantErrorEnd string
+	}{
+		{
+			name:         "everything rolled back",
+			wantErrorEnd: "Everything created so far has been rolled back",
+		},
+		{
+			name:         "bucket left behind",
+			failing:      map[string]bool{"bucket b-2": true},
+			wantOrphans:  []string{"bucket b-2"},
+			wantErrorEnd: "Rollback incomplete, left behind: bucket b-2",
+		},
+		{
+			name:         "group and bucket left behind",
+			failing:      map[string]bool{"group inst": true, "bucket a-1": true},
+			wantOrphans:  []string{"bucket a-1", "group inst"},
+			wantErrorEnd: "Rollback incomplete, left behind: bucket a-1, group inst",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &broker{state: NewStateStore(backend)}
+			op := newOperationTracker(b.state).Start("inst", operationProvision)
+
+			//the group and two buckets were created, then enabling versioning failed. The bucket that was never created isn't compensated.
+			var compensated []string
+			s := newSaga(op)
+			for _, resource := range []string{"group inst", "bucket a-1", "bucket b-2"} {
+				resource := resource
+				kind, name, _ := strings.Cut(resource, " ")
+				s.Done(kind, name, func() error {
+					compensated = append(compensated, resource)
+					if tt.failing[resource] {
+						return errors.New("still exists")
+					}
+					return nil
+				})
+			}
+
+			err = b.abort(s, errors.New("Enabling versioning failed"))
+			if err == nil || !strings.HasSuffix(err.Error(), tt.wantErrorEnd) {
+				t.Errorf("got error %v, want it to end with %q", err, tt.wantErrorEnd)
+			}
+
+			if want := []string{"bucket b-2", "bucket a-1", "group inst"}; !reflect.DeepEqual(compensated, want) {
+				t.Errorf("compensated %v, want %v in reverse order of creation", compensated, want)
+			}
+
+			orphans, err := b.state.ListOrphans()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, orphan := range orphans {
+				if orphan.InstanceID != "inst" || orphan.Operation != op.OperationData() || orphan.Error != "still exists" {
+					t.Errorf("orphan %+v doesn't belong to the operation", orphan)
+				}
+				got = append(got, orphan.Kind+" "+orphan.Name)
+			}
+			if !reflect.DeepEqual(got, tt.wantOrphans) {
+				t.Errorf("got orphans %v, want %v", got, tt.wantOrphans)
+			}
+
+			rec, err := b.state.GetOperation("inst", op.OperationData())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.State != domain.Failed || len(rec.Resources) != 3 {
+				t.Errorf("journaled operation %+v, want it failed with 3 resources", rec)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+// kvBackend is the storage used by the state store. Implemented by fileStore (local file) and s3Store (objects in a StorageGrid bucket).
+type kvBackend interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+}
+
+// stateStore keeps the broker's record of instances, bindings and operations. StorageGrid is reconciled against this record.
+type stateStore struct {
+	backend kvBackend
+}
+
+type bucketRecord struct {
+	Name          string `json:"name"`
+	Region        string `json:"region"`
+	Versioning    bool   `json:"versioning"`
+	Suspended     bool   `json:"versioning_suspended,omitempty"`
+	QuotaExceeded bool   `json:"quota_exceeded,omitempty"`
+	ObjectLock    string `json:"object_lock,omitempty"` //retention mode, empty when Object Lock is not enabled
+	RetentionDays int64  `json:"retention_days,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"` //requested tags, the managed tags are derived from the instance
+
+	Lifecycle []ProvisionParamsLifecycleRule `json:"lifecycle,omitempty"`
+	CORS      []ProvisionParamsCORSRule      `json:"cors,omitempty"`
+
+	Encryption         bool `json:"encryption,omitempty"`
+	EncryptionRequired bool `json:"encryption_required,omitempty"`
+
+	Consistency string `json:"consistency,omitempty"`
+	Replication string `json:"replication,omitempty"`
+}
+
+type instanceRecord struct {
+	InstanceID       string                  `json:"instance_id"`
+	GroupName        string                  `json:"group_name"`
+	ServiceID        string                  `json:"service_id"`
+	PlanID           string                  `json:"plan_id"`
+	OrganizationGUID string                  `json:"organization_guid,omitempty"`
+	SpaceGUID        string                  `json:"space_guid,omitempty"`
+	Context          json.RawMessage         `json:"context,omitempty"`
+	Parameters       json.RawMessage         `json:"parameters,omitempty"`
+	Buckets          map[string]bucketRecord `json:"buckets"`
+	CreatedAt        time.Time               `json:"created_at"`
+	UpdatedAt        time.Time               `json:"updated_at"`
+}
+
+type bindingRecord struct {
+	BindingID            string          `json:"binding_id"`
+	InstanceID           string          `json:"instance_id"`
+	UserName             string          `json:"user_name"`
+	AppGUID              string          `json:"app_guid,omitempty"`
+	PredecessorBindingID string          `json:"predecessor_binding_id,omitempty"`
+	KeyID                string          `json:"key_id,omitempty"`
+	Context              json.RawMessage `json:"context,omitempty"`
+	Parameters           json.RawMessage `json:"parameters,omitempty"`
+	CreatedAt            time.Time       `json:"created_at"`
+}
+
+// operationRecord is the journal entry of an operation. Besides the progress it holds everything needed to resume or compensate
+// the operation when the broker running it dies: the target state of the instance, the buckets to delete and the resources created so far.
+type operationRecord struct {
+	ID           string                    `json:"id"`
+	InstanceID   string                    `json:"instance_id"`
+	Type         operationType             `json:"type"`
+	State        domain.LastOperationState `json:"state"`
+	Description  string                    `json:"description"`
+	Steps        []string                  `json:"steps,omitempty"`
+	Target       *instanceRecord           `json:"target,omitempty"`
+	Delete       map[string]bucketRecord   `json:"delete,omitempty"`
+	Resources    []journalResource         `json:"resources,omitempty"`
+	Owner        string                    `json:"owner,omitempty"`
+	LeaseExpires time.Time                 `json:"lease_expires,omitempty"`
+	Started      time.Time                 `json:"started"`
+	Finished     time.Time                 `json:"finished,omitempty"`
+}
+
+// journalResource is a group or bucket created by an operation
+type journalResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+func NewStateStore(backend kvBackend) *stateStore {
+	return &stateStore{
+		backend: backend,
+	}
+}
+
+func (s *stateStore) get(key string, v interface{}) error {
+	value, err := s.backend.Get(key)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(value, v)
+	if err != nil {
+		return fmt.Errorf("Error parsing state record %s: %s", key, err)
+	}
+
+	return nil
+}
+
+func (s *stateStore) put(key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error marshalling state record %s: %s", key, err)
+	}
+
+	return s.backend.Put(key, value)
+}
+
+// Instances are stored by group name so they can be found from a storageGrid group as well as from an instance ID
+func instanceKey(groupName string) string {
+	return fmt.Sprintf("instances/%s", groupName)
+}
+
+func (s *stateStore) GetInstance(groupName string) (instanceRecord, error) {
+	var rec instanceRecord
+	err := s.get(instanceKey(groupName), &rec)
+
+	return rec, err
+}
+
+func (s *stateStore) PutInstance(rec instanceRecord) error {
+	rec.UpdatedAt = time.Now()
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = rec.UpdatedAt
+	}
+
+	return s.put(instanceKey(rec.GroupName), rec)
+}
+
+func (s *stateStore) DeleteInstance(groupName string) error {
+	return s.backend.Delete(instanceKey(groupName))
+}
+
+func (s *stateStore) ListInstances() ([]instanceRecord, error) {
+	keys, err := s.backend.Keys("instances/")
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []instanceRecord{}
+	for _, key := range keys {
+		var rec instanceRecord
+		if err := s.get(key, &rec); err != nil {
+			return nil, err
+		}
+		instances = append(instances, rec)
+	}
+
+	return instances, nil
+}
+
+func (s *stateStore) GetBinding(bindingID string) (bindingRecord, error) {
+	var rec bindingRecord
+	err := s.get(fmt.Sprintf("bindings/%s", bindingID), &rec)
+
+	return rec, err
+}
+
+func (s *stateStore) PutBinding(rec bindingRecord) error {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+
+	return s.put(fmt.Sprintf("bindings/%s", rec.BindingID), rec)
+}
+
+// Returns the recorded bindings of an instance
+func (s *stateStore) ListBindings(instanceID string) ([]bindingRecord, error) {
+	keys, err := s.backend.Keys("bindings/")
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := []bindingRecord{}
+	for _, key := range keys {
+		var rec bindingRecord
+		if err := s.get(key, &rec); err != nil {
+			return nil, err
+		}
+		if rec.InstanceID == instanceID {
+			bindings = append(bindings, rec)
+		}
+	}
+
+	return bindings, nil
+}
+
+func (s *stateStore) DeleteBinding(bindingID string) error {
+	return s.backend.Delete(fmt.Sprintf("bindings/%s", bindingID))
+}
+
+// Operations are stored per instance. The key starts with the start time so listing them returns the history in order.
+func operationKey(instanceID string, started time.Time, id string) string {
+	return fmt.Sprintf("operations/%s/%020d-%s", instanceID, started.UnixNano(), id)
+}
+
+// Returns the instance and start time of an operation from its key
+func parseOperationKey(key string) (string, time.Time) {
+	parts := strings.SplitN(strings.TrimPrefix(key, "operations/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], time.Time{}
+	}
+
+	var started int64
+	fmt.Sscanf(parts[1], "%020d-", &started)
+	return parts[0], time.Unix(0, started)
+}
+
+func (s *stateStore) PutOperation(rec operationRecord) error {
+	return s.put(operationKey(rec.InstanceID, rec.Started, rec.ID), rec)
+}
+
+func (s *stateStore) ListOperations(instanceID string) ([]operationRecord, error) {
+	keys, err := s.backend.Keys(fmt.Sprintf("operations/%s/", instanceID))
+	if err != nil {
+		return nil, err
+	}
+
+	operations := []operationRecord{}
+	for _, key := range keys {
+		var rec operationRecord
+		if err := s.get(key, &rec); err != nil {
+			return nil, err
+		}
+		operations = append(operations, rec)
+	}
+
+	return operations, nil
+}
+
+// Returns the operations of all instances that haven't finished. Only the latest operation of an instance is considered.
+func (s *stateStore) ListUnfinishedOperations() ([]operationRecord, error) {
+	keys, err := s.backend.Keys("operations/")
+	if err != nil {
+		return nil, err
+	}
+
+	//keys are sorted so the last key of an instance is its latest operation
+	latest := make(map[string]string)
+	var instances []string
+	for _, key := range keys {
+		instanceID, _ := parseOperationKey(key)
+		if _, ok := latest[instanceID]; !ok {
+			instances = append(instances, instanceID)
+		}
+		latest[instanceID] = key
+	}
+
+	unfinished := []operationRecord{}
+	for _, instanceID := range instances {
+		var rec operationRecord
+		if err := s.get(latest[instanceID], &rec); err != nil {
+			return nil, err
+		}
+		if rec.State == domain.InProgress {
+			unfinished = append(unfinished, rec)
+		}
+	}
+
+	return unfinished, nil
+}
+
+// Deletes operations that finished before the cutoff. The latest operation of an instance is kept because LastOperation reports it,
+// unless it's a deprovision that succeeded. Returns the number of deleted operations.
+func (s *stateStore) PruneOperations(cutoff time.Time) (int, error) {
+	keys, err := s.backend.Keys("operations/")
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for i, key := range keys {
+		//an operation finishes after it started, so only operations started before the cutoff have to be read
+		instanceID, started := parseOperationKey(key)
+		if !started.Before(cutoff) {
+			continue
+		}
+
+		var rec operationRecord
+		if err := s.get(key, &rec); err != nil {
+			return pruned, err
+		}
+		if rec.State == domain.InProgress || rec.Finished.After(cutoff) {
+			continue
+		}
+
+		//keys are sorted so the last key of an instance is its latest operation
+		latest := i+1 == len(keys)
+		if !latest {
+			next, _ := parseOperationKey(keys[i+1])
+			latest = next != instanceID
+		}
+		if latest && !(rec.Type == operationDeprovision && rec.State == domain.Succeeded) {
+			continue
+		}
+
+		if err := s.backend.Delete(key); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// Finds an operation by the operation data handed to the platform
+func (s *stateStore) GetOperation(instanceID, operationData string) (operationRecord, error) {
+	operations, err := s.ListOperations(instanceID)
+	if err != nil {
+		return operationRecord{}, err
+	}
+
+	for i := len(operations) - 1; i >= 0; i-- {
+		op := operations[i]
+		if operationData == "" || fmt.Sprintf("%s:%s", op.Type, op.ID) == operationData {
+			return op, nil
+		}
+	}
+
+	return operationRecord{}, errKeyNotFound
+}
+
+func orphanKey(orphan orphanRecord) string {
+	return fmt.Sprintf("orphans/%s/%s", orphan.Kind, orphan.Name)
+}
+
+func (s *stateStore) PutOrphan(orphan orphanRecord) error {
+	return s.put(orphanKey(orphan), orphan)
+}
+
+func (s *stateStore) DeleteOrphan(orphan orphanRecord) error {
+	return s.backend.Delete(orphanKey(orphan))
+}
+
+func (s *stateStore) ListOrphans() ([]orphanRecord, error) {
+	keys, err := s.backend.Keys("orphans/")
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []orphanRecord{}
+	for _, key := range keys {
+		var orphan orphanRecord
+		if err := s.get(key, &orphan); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+func bucketsToRecords(buckets map[string]Bucket) map[string]bucketRecord {
+	records := make(map[string]bucketRecord)
+	for friendlyName, bckt := range buckets {
+		records[friendlyName] = bucketRecord{
+			Name:          bckt.name,
+			Region:        bckt.region,
+			Versioning:    bckt.versioning,
+			Suspended:     bckt.suspended,
+			QuotaExceeded: bckt.quotaExceeded,
+			ObjectLock:    bckt.objectLock.mode,
+			RetentionDays: bckt.objectLock.days,
+			Tags:          bckt.tags,
+			Lifecycle:     bckt.lifecycle,
+			CORS:          bckt.cors,
+
+			Encryption:         bckt.encryption,
+			EncryptionRequired: bckt.encryptionRequired,
+
+			Consistency: bckt.consistency,
+			Replication: bckt.replication,
+		}
+	}
+
+	return records
+}
+
+func recordsToBuckets(records map[string]bucketRecord) map[string]Bucket {
+	buckets := make(map[string]Bucket)
+	for friendlyName, rec := range records {
+		buckets[friendlyName] = Bucket{
+			name:          rec.Name,
+			region:        rec.Region,
+			versioning:    rec.Versioning,
+			suspended:     rec.Suspended,
+			quotaExceeded: rec.QuotaExceeded,
+			objectLock: objectLockConfig{
+				mode: rec.ObjectLock,
+				days: rec.RetentionDays,
+			},
+			tags:      rec.Tags,
+			lifecycle: rec.Lifecycle,
+			cors:      rec.CORS,
+
+			encryption:         rec.Encryption,
+			encryptionRequired: rec.EncryptionRequired,
+
+			consistency: rec.Consistency,
+			replication: rec.Replication,
+		}
+	}
+
+	return buckets
+}
+
+// Returns the recorded instance or, when there is none (yet), a new record for it
+func (b *broker) getInstanceRecord(instanceID string) instanceRecord {
+	groupName := strings.ReplaceAll(instanceID, "-", "")
+
+	if b.state != nil {
+		rec, err := b.state.GetInstance(groupName)
+		if err == nil {
+			return rec
+		}
+		if err != errKeyNotFound {
+			log.Printf("Error retrieving instance %s from state store: %s", instanceID, err)
+		}
+	}
+
+	//the plan isn't known without a record, see planFromBuckets
+	return instanceRecord{
+		InstanceID: instanceID,
+		GroupName:  groupName,
+	}
+}
+
+// Derives the plan of an unrecorded instance from the encryption marker in its group policy. Instances on a plan with a quota
+// are always recorded, so the plan is known when exactly one plan without a quota matches. Returns empty IDs otherwise.
+func (b *broker) planFromBuckets(buckets map[string]Bucket) (string, string) {
+	if len(buckets) == 0 {
+		return "", ""
+	}
+
+	encrypted := false
+	for _, bckt := range buckets {
+		encrypted = bckt.encryptionRequired
+		break
+	}
+
+	var serviceID, planID string
+	for _, service := range b.services {
+		for _, plan := range service.Plans {
+			if servicePlanQuotaGB(plan) > 0 || b.planRequiresEncryption(plan.ID) != encrypted {
+				continue
+			}
+			if planID != "" {
+				return "", ""
+			}
+			serviceID, planID = service.ID, plan.ID
+		}
+	}
+
+	return serviceID, planID
+}
+
+// Records the buckets of an instance in the state store. Does nothing when no state store is configured.
+func (b *broker) recordInstance(rec instanceRecord, buckets map[string]Bucket) error {
+	if b.state == nil {
+		return nil
+	}
+
+	rec.Buckets = bucketsToRecords(buckets)
+	if err := b.state.PutInstance(rec); err != nil {
+		return fmt.Errorf("Error recording instance %s: %s", rec.InstanceID, err)
+	}
+
+	return nil
+}
+
+func (b *broker) forgetInstance(groupName string) error {
+	if b.state == nil {
+		return nil
+	}
+
+	if err := b.state.DeleteInstance(groupName); err != nil {
+		return fmt.Errorf("Error removing instance %s from state store: %s", groupName, err)
+	}
+
+	return nil
+}
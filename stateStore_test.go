@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi/domain"
+)
+
+func TestPruneOperations(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	operations := []operationRecord{
+		{ID: "provision", InstanceID: "a", Type: operationProvision, State: domain.Succeeded, Started: old, Finished: old.Add(time.Minute)},
+		{ID: "update", InstanceID: "a", Type: operationUpdate, State: domain.Failed, Started: old.Add(time.Hour), Finished: old.Add(2 * time.Hour)},
+		{ID: "stuck", InstanceID: "b", Type: operationUpdate, State: domain.InProgress, Started: old},
+		{ID: "recent", InstanceID: "b", Type: operationUpdate, State: domain.Succeeded, Started: now, Finished: now},
+		{ID: "provision", InstanceID: "c", Type: operationProvision, State: domain.Succeeded, Started: old, Finished: old.Add(time.Minute)},
+		{ID: "deprovision", InstanceID: "c", Type: operationDeprovision, State: domain.Succeeded, Started: old.Add(time.Hour), Finished: old.Add(2 * time.Hour)},
+	}
+	for _, rec := range operations {
+		if err := state.PutOperation(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruned, err := state.PruneOperations(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Errorf("pruned %d operations, want 3", pruned)
+	}
+
+	for instanceID, want := range map[string]string{"a": "update", "b": "stuck,recent", "c": ""} {
+		recs, err := state.ListOperations(instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, rec := range recs {
+			got = append(got, rec.ID)
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("instance %s: got operations %v, want %s", instanceID, got, want)
+		}
+	}
+}
+
+func TestOperationTrackerUnfinished(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	now := time.Now()
+	operations := []operationRecord{
+		{ID: "provision", InstanceID: "finished", Type: operationProvision, State: domain.Succeeded, Started: now, Finished: now},
+		{ID: "provision", InstanceID: "elsewhere", Type: operationProvision, State: domain.Succeeded, Started: now, Finished: now},
+		{ID: "update", InstanceID: "elsewhere", Type: operationUpdate, State: domain.InProgress, Started: now.Add(time.Minute)},
+	}
+	for _, rec := range operations {
+		if err := state.PutOperation(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := newOperationTracker(state)
+	tracker.Start("local", operationUpdate)
+
+	for instanceID, want := range map[string]bool{"finished": false, "elsewhere": true, "local": true, "unknown": false} {
+		if got := tracker.Unfinished(instanceID); got != want {
+			t.Errorf("instance %s: got unfinished %v, want %v", instanceID, got, want)
+		}
+	}
+}
+
+func TestPlanFromBuckets(t *testing.T) {
+	services, err := CatalogLoad("catalog.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		standard  = "a31fec23-a86b-4d3a-87d2-f44b620b9c04"
+		encrypted = "3a047355-1e8a-4994-8029-1afbef6b7bb0"
+	)
+
+	tests := []struct {
+		name    string
+		buckets map[string]Bucket
+		want    string
+	}{
+		{"no buckets", nil, ""},
+		{"unencrypted", map[string]Bucket{"a": {name: "a"}}, standard},
+		{"encryption required", map[string]Bucket{"a": {name: "a", encryptionRequired: true}}, encrypted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &broker{services: services}
+			serviceID, planID := b.planFromBuckets(tt.buckets)
+			if planID != tt.want {
+				t.Errorf("got plan %q, want %q", planID, tt.want)
+			}
+			if (serviceID != "") != (tt.want != "") {
+				t.Errorf("got service %q for plan %q", serviceID, planID)
+			}
+		})
+	}
+}
+
+func TestOperationTrackerRunning(t *testing.T) {
+	backend, err := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewStateStore(backend)
+
+	err = state.PutOperation(operationRecord{ID: "provision", InstanceID: "elsewhere", Type: operationProvision, State: domain.InProgress, Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := newOperationTracker(state)
+	tracker.Start("local", operationUpdate)
+
+	tests := []struct {
+		instanceID string
+		wantType   operationType
+		wantOK     bool
+	}{
+		{"elsewhere", operationProvision, true},
+		{"local", operationUpdate, true},
+		{"unknown", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.instanceID, func(t *testing.T) {
+			opType, running := tracker.Running(tt.instanceID)
+			if opType != tt.wantType || running != tt.wantOK {
+				t.Errorf("got %q, %v, want %q, %v", opType, running, tt.wantType, tt.wantOK)
+			}
+		})
+	}
+}
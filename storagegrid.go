@@ -69,6 +69,42 @@ type sgS3Cred struct {
 	SecretAccessKey string `json:"secretAccessKey"`
 }
 
+type sgBucketUsage struct {
+	Name        string `json:"name"`
+	ObjectCount int64  `json:"objectCount"`
+	DataBytes   int64  `json:"dataBytes"`
+}
+
+type sgUsage struct {
+	CalculationTime string          `json:"calculationTime"`
+	ObjectCount     int64           `json:"objectCount"`
+	DataBytes       int64           `json:"dataBytes"`
+	Buckets         []sgBucketUsage `json:"buckets"`
+}
+
+type sgConsistency struct {
+	Consistency string `json:"consistency"`
+}
+
+type sgEndpoint struct {
+	ID          string         `json:"id,omitempty"`
+	DisplayName string         `json:"displayName"`
+	EndpointURI string         `json:"endpointURI"`
+	EndpointURN string         `json:"endpointURN"`
+	Auth        sgEndpointAuth `json:"auth"`
+	InsecureTLS bool           `json:"insecureTLS"`
+}
+
+type sgEndpointAuth struct {
+	Type string            `json:"type"`
+	S3   *sgEndpointS3Auth `json:"s3,omitempty"`
+}
+
+type sgEndpointS3Auth struct {
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
 func (e apiError) Error() string {
 	return fmt.Sprintf("%s. return code: %v. return body: %s", e.err, e.statusCode, e.body)
 }
@@ -236,9 +272,14 @@ func (s *storageGridClient) DoApiRequest(method, path string, body []byte, check
 	return apiResp, nil
 }
 
-// Creates S3 creds for a user
-func (s *storageGridClient) CreateS3CredsForUser(userid string) (sgS3Cred, error) {
-	credsInfo := struct{}{}
+// Creates S3 creds for a user. The creds expire at the given time, a zero time creates creds that never expire.
+func (s *storageGridClient) CreateS3CredsForUser(userid string, expires time.Time) (sgS3Cred, error) {
+	credsInfo := struct {
+		Expires string `json:"expires,omitempty"`
+	}{}
+	if !expires.IsZero() {
+		credsInfo.Expires = expires.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
 	reqBody, _ := json.Marshal(credsInfo)
 
 	createResp, err := s.DoApiRequest("POST", fmt.Sprintf("org/users/%s/s3-access-keys", userid), reqBody, http.StatusCreated)
@@ -277,6 +318,31 @@ func (s *storageGridClient) CreateS3CredsForCurrentUser(expires time.Time) (sgS3
 	return s3cred, nil
 }
 
+// Lists the S3 creds of a user. The secret access keys are not returned.
+func (s *storageGridClient) ListS3CredsForUser(userid string) ([]sgS3Cred, error) {
+	listResp, err := s.DoApiRequest("GET", fmt.Sprintf("org/users/%s/s3-access-keys", userid), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var s3creds []sgS3Cred
+	err = json.Unmarshal(listResp.Data, &s3creds)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3creds, nil
+}
+
+func (s *storageGridClient) DeleteS3CredsForUser(userid, id string) error {
+	_, err := s.DoApiRequest("DELETE", fmt.Sprintf("org/users/%s/s3-access-keys/%s", userid, id), nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *storageGridClient) DeleteS3CredsForCurrentUser(id string) error {
 	_, err := s.DoApiRequest("DELETE", fmt.Sprintf("org/users/current-user/s3-access-keys/%s", id), nil, http.StatusNoContent)
 	if err != nil {
@@ -286,6 +352,86 @@ func (s *storageGridClient) DeleteS3CredsForCurrentUser(id string) error {
 	return nil
 }
 
+// Returns the storage usage of the tenant and of each of its buckets
+func (s *storageGridClient) GetUsage() (sgUsage, error) {
+	usageResp, err := s.DoApiRequest("GET", "org/usage", nil, http.StatusOK)
+	if err != nil {
+		return sgUsage{}, err
+	}
+
+	var usage sgUsage
+	err = json.Unmarshal(usageResp.Data, &usage)
+	if err != nil {
+		return sgUsage{}, fmt.Errorf("Error unmarshalling usage %s", err)
+	}
+
+	return usage, nil
+}
+
+func (s *storageGridClient) GetBucketConsistency(bucketName string) (string, error) {
+	consistencyResp, err := s.DoApiRequest("GET", fmt.Sprintf("org/containers/%s/consistency", bucketName), nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+
+	var consistency sgConsistency
+	err = json.Unmarshal(consistencyResp.Data, &consistency)
+	if err != nil {
+		return "", fmt.Errorf("Error unmarshalling consistency %s", err)
+	}
+
+	return consistency.Consistency, nil
+}
+
+func (s *storageGridClient) SetBucketConsistency(bucketName, consistency string) error {
+	reqBody, err := json.Marshal(sgConsistency{Consistency: consistency})
+	if err != nil {
+		return fmt.Errorf("Marshalling consistency to json failed: %s", err)
+	}
+
+	_, err = s.DoApiRequest("PUT", fmt.Sprintf("org/containers/%s/consistency", bucketName), reqBody, http.StatusOK)
+	return err
+}
+
+func (s *storageGridClient) ListEndpoints() ([]sgEndpoint, error) {
+	endpointsResp, err := s.DoApiRequest("GET", "org/endpoints", nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []sgEndpoint
+	err = json.Unmarshal(endpointsResp.Data, &endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling endpoints %s", err)
+	}
+
+	return endpoints, nil
+}
+
+func (s *storageGridClient) CreateEndpoint(endpoint sgEndpoint) (sgEndpoint, error) {
+	reqBody, err := json.Marshal(endpoint)
+	if err != nil {
+		return sgEndpoint{}, fmt.Errorf("Marshalling endpoint object to json failed: %s", err)
+	}
+
+	result, err := s.DoApiRequest("POST", "org/endpoints", reqBody, http.StatusCreated)
+	if err != nil {
+		return sgEndpoint{}, err
+	}
+
+	err = json.Unmarshal(result.Data, &endpoint)
+	if err != nil {
+		return sgEndpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+func (s *storageGridClient) DeleteEndpoint(endpointID string) error {
+	_, err := s.DoApiRequest("DELETE", fmt.Sprintf("org/endpoints/%s", endpointID), nil, http.StatusNoContent)
+	return err
+}
+
 func (s *storageGridClient) GetUserByName(userName string) (sgUser, error) {
 	userResp, err := s.DoApiRequest("GET", fmt.Sprintf("org/users/user/%s", userName), nil, http.StatusOK)
 	if err != nil {
@@ -354,9 +500,9 @@ func (s *storageGridClient) DeleteUser(userID string) error {
 	return nil
 }
 
-func (s *storageGridClient) CreateGroup(groupName, policy string) (sgGroup, error) {
+func (s *storageGridClient) CreateGroup(groupName, displayName, policy string) (sgGroup, error) {
 	grp := sgGroup{
-		DisplayName: groupName,
+		DisplayName: displayName,
 		UniqueName:  fmt.Sprintf("group/%s", groupName),
 		Policies:    json.RawMessage(policy),
 	}
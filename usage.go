@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type bucketUsage struct {
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	ObjectCount int64  `json:"object_count"`
+	DataBytes   int64  `json:"data_bytes"`
+}
+
+type instanceUsageReport struct {
+	InstanceID      string        `json:"instance_id"`
+	ObjectCount     int64         `json:"object_count"`
+	DataBytes       int64         `json:"data_bytes"`
+	QuotaBytes      int64         `json:"quota_bytes,omitempty"`
+	CalculationTime string        `json:"calculation_time"`
+	Buckets         []bucketUsage `json:"buckets"`
+}
+
+// Aggregates the tenant usage over the buckets of an instance
+func bucketsUsage(instanceID string, buckets map[string]Bucket, usage sgUsage) instanceUsageReport {
+	byName := make(map[string]sgBucketUsage)
+	for _, bckt := range usage.Buckets {
+		byName[bckt.Name] = bckt
+	}
+
+	report := instanceUsageReport{
+		InstanceID:      instanceID,
+		CalculationTime: usage.CalculationTime,
+		Buckets:         []bucketUsage{},
+	}
+
+	for friendlyName, bckt := range buckets {
+		used := byName[bckt.name]
+		report.Buckets = append(report.Buckets, bucketUsage{
+			Name:        friendlyName,
+			Bucket:      bckt.name,
+			ObjectCount: used.ObjectCount,
+			DataBytes:   used.DataBytes,
+		})
+		report.ObjectCount += used.ObjectCount
+		report.DataBytes += used.DataBytes
+	}
+	sort.Slice(report.Buckets, func(i, j int) bool { return report.Buckets[i].Name < report.Buckets[j].Name })
+
+	return report
+}
+
+// Returns the usage of the buckets of an instance
+func (b *broker) getInstanceUsage(instanceID string, buckets map[string]Bucket) (instanceUsageReport, error) {
+	usage, err := b.sgClient.GetUsage()
+	if err != nil {
+		return instanceUsageReport{}, fmt.Errorf("Error retrieving usage from storageGrid: %s", err)
+	}
+
+	report := bucketsUsage(instanceID, buckets, usage)
+	report.QuotaBytes = b.instanceQuota(b.getInstanceRecord(instanceID))
+
+	return report, nil
+}
+
+// Returns the storage usage of an instance (?instance=<instance id>)
+func (a adminAPI) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(w, r) {
+		return
+	}
+
+	instanceID := r.URL.Query().Get("instance")
+	if instanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	grp, err := a.s.GetGroupByName(strings.ReplaceAll(instanceID, "-", ""))
+	if err != nil {
+		if ae, ok := err.(apiError); ok && ae.statusCode == http.StatusNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error getting group from storageGrid: %s", err)
+		return
+	}
+
+	buckets, err := a.b.getBucketsFromGroup(grp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error getting buckets for group %s: %s", grp.DisplayName, err)
+		return
+	}
+
+	report, err := a.b.getInstanceUsage(instanceID, buckets)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// brokerapi v6 has no instance metadata (OSB 2.17). GetInstance hands it to this middleware through the request context and it is added to the response.
+const instanceMetadataKey contextKey = "instance_metadata"
+
+var instancePath = regexp.MustCompile(`^/v2/service_instances/[^/]+$`)
+
+type instanceMetadata struct {
+	Labels     map[string]interface{} `json:"labels,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func setInstanceMetadata(ctx context.Context, metadata instanceMetadata) {
+	if holder, ok := ctx.Value(instanceMetadataKey).(*instanceMetadata); ok {
+		*holder = metadata
+	}
+}
+
+func instanceMetadataMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !instancePath.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metadata := &instanceMetadata{}
+		ctx := context.WithValue(r.Context(), instanceMetadataKey, metadata)
+
+		rewriteResponse(w, r.WithContext(ctx), next, func(body map[string]interface{}) {
+			if len(metadata.Labels) > 0 || len(metadata.Attributes) > 0 {
+				body["metadata"] = metadata
+			}
+		})
+	})
+}
+
+// Adds the usage of an instance to the instance metadata. Usage is informational so errors are only logged.
+func (b *broker) reportInstanceUsage(ctx context.Context, instanceID string, buckets map[string]Bucket) {
+	report, err := b.getInstanceUsage(instanceID, buckets)
+	if err != nil {
+		log.Printf("Unable to report usage of instance %s: %s", instanceID, err)
+		return
+	}
+
+	setInstanceMetadata(ctx, instanceMetadata{
+		Attributes: map[string]interface{}{
+			"usage": report,
+		},
+	})
+}